@@ -0,0 +1,52 @@
+package mockdns
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// ACL restricts access to Server by client address.
+type ACL struct {
+	// Allow, if not empty, lists the only networks of clients that are
+	// permitted.
+	Allow []*net.IPNet
+
+	// Deny lists networks of clients that are refused. It takes precedence
+	// over Allow.
+	Deny []*net.IPNet
+}
+
+// permits reports whether the client is permitted by the ACL. Clients with
+// unknown address are permitted only if Allow is empty.
+func (a ACL) permits(client net.IP) bool {
+	if client == nil {
+		return len(a.Allow) == 0
+	}
+	for _, n := range a.Deny {
+		if n.Contains(client) {
+			return false
+		}
+	}
+	if len(a.Allow) == 0 {
+		return true
+	}
+	for _, n := range a.Allow {
+		if n.Contains(client) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkACL reports whether the query q from the client is permitted by
+// QueryACL and, for zone transfers, TransferACL.
+func (s *Server) checkACL(q dns.Question, client net.IP) bool {
+	if !s.QueryACL.permits(client) {
+		return false
+	}
+	if q.Qtype == dns.TypeAXFR || q.Qtype == dns.TypeIXFR {
+		return s.TransferACL.permits(client)
+	}
+	return true
+}
@@ -0,0 +1,64 @@
+package mockdns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestServer_ACL(t *testing.T) {
+	srv, err := NewServer(map[string]Zone{
+		"example.org.": {
+			A: []string{"1.2.3.4"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	mustCIDR := func(s string) *net.IPNet {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	srv.QueryACL = ACL{
+		Allow: []*net.IPNet{mustCIDR("10.0.0.0/8"), mustCIDR("192.0.2.0/24")},
+		Deny:  []*net.IPNet{mustCIDR("10.66.0.0/16")},
+	}
+	srv.TransferACL = ACL{
+		Allow: []*net.IPNet{mustCIDR("192.0.2.53/32")},
+	}
+
+	cases := []struct {
+		client string
+		qtype  uint16
+		rcode  int
+	}{
+		{"10.1.2.3", dns.TypeA, dns.RcodeSuccess},
+		{"192.0.2.1", dns.TypeA, dns.RcodeSuccess},
+		{"10.66.1.1", dns.TypeA, dns.RcodeRefused},
+		{"198.51.100.1", dns.TypeA, dns.RcodeRefused},
+		{"10.1.2.3", dns.TypeAXFR, dns.RcodeRefused},
+		{"192.0.2.1", dns.TypeIXFR, dns.RcodeRefused},
+		{"192.0.2.53", dns.TypeAXFR, dns.RcodeSuccess},
+	}
+	for _, c := range cases {
+		msg := new(dns.Msg)
+		msg.SetQuestion("example.org.", c.qtype)
+		reply, err := srv.exchange(&memWriter{
+			local:  srv.LocalAddr(),
+			remote: &net.TCPAddr{IP: net.ParseIP(c.client), Port: 53000},
+		}, msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reply.Rcode != c.rcode {
+			t.Errorf("%s %s: want %s, got %s", c.client, dns.TypeToString[c.qtype],
+				dns.RcodeToString[c.rcode], dns.RcodeToString[reply.Rcode])
+		}
+	}
+}
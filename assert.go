@@ -0,0 +1,53 @@
+package mockdns
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+// DNSErrorSpec describes the expected *net.DNSError fields for
+// AssertDNSError.
+type DNSErrorSpec struct {
+	// Name is compared against DNSError.Name. It is not checked if empty.
+	Name string
+
+	IsNotFound  bool
+	IsTimeout   bool
+	IsTemporary bool
+}
+
+// AssertDNSError fails the test if err is not a *net.DNSError or if
+// its fields do not match want. All mismatched fields are reported at once.
+func AssertDNSError(tb testing.TB, err error, want DNSErrorSpec) {
+	tb.Helper()
+
+	if err == nil {
+		tb.Fatalf("Expected *net.DNSError, got nil")
+		return
+	}
+	dnsErr, ok := err.(*net.DNSError)
+	if !ok {
+		tb.Fatalf("err is not *net.DNSError, but %T: %v", err, err)
+		return
+	}
+
+	var diff []string
+	check := func(field string, want, got interface{}) {
+		if want != got {
+			diff = append(diff, fmt.Sprintf("\t%s: want %v, got %v", field, want, got))
+		}
+	}
+
+	if want.Name != "" {
+		check("Name", want.Name, dnsErr.Name)
+	}
+	check("IsNotFound", want.IsNotFound, isNotFound(dnsErr))
+	check("IsTimeout", want.IsTimeout, dnsErr.IsTimeout)
+	check("IsTemporary", want.IsTemporary, dnsErr.IsTemporary)
+
+	if len(diff) != 0 {
+		tb.Errorf("DNSError mismatch (%v):\n%s", dnsErr, strings.Join(diff, "\n"))
+	}
+}
@@ -0,0 +1,55 @@
+package mockdns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+type fakeTB struct {
+	testing.TB
+	failures []string
+}
+
+func (f *fakeTB) Helper() {}
+
+func (f *fakeTB) Errorf(format string, args ...interface{}) {
+	f.failures = append(f.failures, fmt.Sprintf(format, args...))
+}
+
+func (f *fakeTB) Fatalf(format string, args ...interface{}) {
+	f.failures = append(f.failures, fmt.Sprintf(format, args...))
+}
+
+func TestAssertDNSError(t *testing.T) {
+	r := Resolver{Zones: map[string]Zone{}}
+
+	_, err := r.LookupHost(context.Background(), "example.org.")
+	AssertDNSError(t, err, DNSErrorSpec{
+		Name:       "example.org.",
+		IsNotFound: true,
+	})
+
+	var ftb fakeTB
+	AssertDNSError(&ftb, err, DNSErrorSpec{
+		Name:      "example.com.",
+		IsTimeout: true,
+	})
+	if len(ftb.failures) != 1 {
+		t.Fatalf("Expected one failure, got %v", ftb.failures)
+	}
+	t.Log(ftb.failures[0])
+
+	ftb.failures = nil
+	AssertDNSError(&ftb, errors.New("not a DNS error"), DNSErrorSpec{})
+	if len(ftb.failures) != 1 {
+		t.Fatalf("Expected one failure, got %v", ftb.failures)
+	}
+
+	ftb.failures = nil
+	AssertDNSError(&ftb, nil, DNSErrorSpec{})
+	if len(ftb.failures) != 1 {
+		t.Fatalf("Expected one failure, got %v", ftb.failures)
+	}
+}
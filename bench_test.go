@@ -0,0 +1,62 @@
+package mockdns
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func benchZones(n int) map[string]Zone {
+	zones := make(map[string]Zone, n)
+	for i := 0; i < n; i++ {
+		zones[fmt.Sprintf("host%d.example.org.", i)] = Zone{
+			A: []string{"1.2.3.4"},
+		}
+	}
+	return zones
+}
+
+func BenchmarkResolver_LookupHost(b *testing.B) {
+	for _, n := range []int{10, 10000, 100000} {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			r := Resolver{Zones: benchZones(n)}
+			name := fmt.Sprintf("Host%d.Example.org", n/2)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := r.LookupHost(context.Background(), name); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkServer_Exchange(b *testing.B) {
+	for _, n := range []int{10, 10000, 100000} {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			srv, err := NewServerWithLogger(benchZones(n), log.New(ioutil.Discard, "", 0))
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer srv.Close()
+
+			name := fmt.Sprintf("host%d.example.org.", n/2)
+			msg := new(dns.Msg)
+			msg.SetQuestion(name, dns.TypeA)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := srv.Exchange(msg); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
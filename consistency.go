@@ -0,0 +1,163 @@
+package mockdns
+
+import (
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Inconsistency describes the mismatch between forward (A, AAAA) and reverse
+// (PTR) records found by CheckForwardReverse.
+type Inconsistency struct {
+	// Name is the forward name. For PTR records, it is the PTR target.
+	Name string
+	IP   string
+
+	// Problem is the description of the mismatch, either "no PTR record for
+	// address" or "no address record for PTR".
+	Problem string
+}
+
+func (i Inconsistency) String() string {
+	return i.Name + " " + i.IP + ": " + i.Problem
+}
+
+// CheckForwardReverse checks that each address in Zones has the PTR record
+// pointing to the name and that each PTR record target resolves to the
+// address, following CNAMEs in Zones unless SkipCNAME is set.
+//
+// Only Zones is used: the check does not count as lookups, does not use
+// Fallback, Default and Limit and does not affect Order and
+// Zone.FailAfter state. Wildcards are not checked. Returned list is sorted
+// by name and address.
+func (r *Resolver) CheckForwardReverse() []Inconsistency {
+	var res []Inconsistency
+
+	for name, zone := range r.Zones {
+		if strings.HasPrefix(name, "*.") {
+			continue
+		}
+
+		addrs := make([]string, 0, len(zone.A)+len(zone.AAAA))
+		addrs = append(addrs, zone.A...)
+		addrs = append(addrs, zone.AAAA...)
+		for _, addr := range addrs {
+			var names []string
+			if arpa, err := dns.ReverseAddr(addr); err == nil && r.Zones[arpa].Err == nil {
+				names = r.Zones[arpa].PTR
+			}
+			if !containsName(names, name) {
+				res = append(res, Inconsistency{
+					Name:    name,
+					IP:      addr,
+					Problem: "no PTR record for address",
+				})
+			}
+		}
+
+		ip := arpaToIP(name)
+		if ip == nil {
+			continue
+		}
+		for _, target := range zone.PTR {
+			if !containsIP(r.staticAddrs(target), ip) {
+				res = append(res, Inconsistency{
+					Name:    target,
+					IP:      ip.String(),
+					Problem: "no address record for PTR",
+				})
+			}
+		}
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Name != res[j].Name {
+			return res[i].Name < res[j].Name
+		}
+		if res[i].IP != res[j].IP {
+			return res[i].IP < res[j].IP
+		}
+		return res[i].Problem < res[j].Problem
+	})
+	return res
+}
+
+// staticAddrs returns A and AAAA records of name in Zones, following CNAMEs
+// unless SkipCNAME is set.
+func (r *Resolver) staticAddrs(name string) []string {
+	name = strings.ToLower(dns.Fqdn(name))
+	seen := make(map[string]bool)
+	for !seen[name] {
+		seen[name] = true
+		zone, ok := r.Zones[name]
+		if !ok || zone.Err != nil {
+			return nil
+		}
+		if zone.CNAME != "" && !r.SkipCNAME {
+			name = strings.ToLower(dns.Fqdn(zone.CNAME))
+			continue
+		}
+		addrs := make([]string, 0, len(zone.A)+len(zone.AAAA))
+		addrs = append(addrs, zone.A...)
+		return append(addrs, zone.AAAA...)
+	}
+	// CNAME loop.
+	return nil
+}
+
+func containsName(names []string, name string) bool {
+	for _, n := range names {
+		if strings.EqualFold(dns.Fqdn(n), dns.Fqdn(name)) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsIP(addrs []string, ip net.IP) bool {
+	for _, addr := range addrs {
+		if ip.Equal(net.ParseIP(addr)) {
+			return true
+		}
+	}
+	return false
+}
+
+// arpaToIP converts the reverse lookup name (as returned by
+// dns.ReverseAddr) back into the IP address. nil is returned if name is not
+// a valid reverse lookup name.
+func arpaToIP(name string) net.IP {
+	name = strings.ToLower(dns.Fqdn(name))
+
+	switch {
+	case strings.HasSuffix(name, ".in-addr.arpa."):
+		labels := strings.Split(strings.TrimSuffix(name, ".in-addr.arpa."), ".")
+		if len(labels) != 4 {
+			return nil
+		}
+		for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+			labels[i], labels[j] = labels[j], labels[i]
+		}
+		return net.ParseIP(strings.Join(labels, ".")).To4()
+	case strings.HasSuffix(name, ".ip6.arpa."):
+		nibbles := strings.Split(strings.TrimSuffix(name, ".ip6.arpa."), ".")
+		if len(nibbles) != 32 {
+			return nil
+		}
+		var sb strings.Builder
+		for i := len(nibbles) - 1; i >= 0; i-- {
+			if len(nibbles[i]) != 1 {
+				return nil
+			}
+			sb.WriteString(nibbles[i])
+			if i%4 == 0 && i != 0 {
+				sb.WriteByte(':')
+			}
+		}
+		return net.ParseIP(sb.String())
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,88 @@
+package mockdns
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestResolver_CheckForwardReverse(t *testing.T) {
+	r := Resolver{Zones: map[string]Zone{
+		"ok.example.org.": {
+			A:    []string{"1.2.3.4"},
+			AAAA: []string{"2001:db8::1"},
+		},
+		"4.3.2.1.in-addr.arpa.": {
+			PTR: []string{"ok.example.org."},
+		},
+		"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.": {
+			PTR: []string{"OK.example.org"},
+		},
+		"noptr.example.org.": {
+			A: []string{"1.2.3.5"},
+		},
+		"6.3.2.1.in-addr.arpa.": {
+			PTR: []string{"noaddr.example.org."},
+		},
+		"wrong.example.org.": {
+			A: []string{"1.2.3.7"},
+		},
+		"7.3.2.1.in-addr.arpa.": {
+			PTR: []string{"other.example.org."},
+		},
+	}}
+
+	want := []Inconsistency{
+		{Name: "noaddr.example.org.", IP: "1.2.3.6", Problem: "no address record for PTR"},
+		{Name: "noptr.example.org.", IP: "1.2.3.5", Problem: "no PTR record for address"},
+		{Name: "other.example.org.", IP: "1.2.3.7", Problem: "no address record for PTR"},
+		{Name: "wrong.example.org.", IP: "1.2.3.7", Problem: "no PTR record for address"},
+	}
+	if got := r.CheckForwardReverse(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Wrong result, want %v, got %v", want, got)
+	}
+}
+
+func TestResolver_CheckForwardReverse_NoSideEffects(t *testing.T) {
+	r := Resolver{
+		Zones: map[string]Zone{
+			"example.org.": {
+				A:         []string{"1.2.3.4", "1.2.3.5"},
+				FailAfter: 1,
+			},
+			"4.3.2.1.in-addr.arpa.": {
+				PTR: []string{"alias.example.org."},
+			},
+			"5.3.2.1.in-addr.arpa.": {
+				PTR: []string{"example.org."},
+			},
+			"alias.example.org.": {
+				CNAME: "example.org.",
+			},
+			"*.example.org.": {
+				A: []string{"1.2.3.9"},
+			},
+		},
+		Limit: 1,
+	}
+
+	want := []Inconsistency{
+		{Name: "example.org.", IP: "1.2.3.4", Problem: "no PTR record for address"},
+	}
+	if got := r.CheckForwardReverse(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Wrong result, want %v, got %v", want, got)
+	}
+
+	if n := r.QueryCount(dns.TypeNone, "example.org."); n != 0 {
+		t.Errorf("Check is counted as %d queries", n)
+	}
+	addrs, err := r.LookupHost(context.Background(), "example.org")
+	if err != nil {
+		t.Fatal("FailAfter counter is used by the check:", err)
+	}
+	if !reflect.DeepEqual(addrs, []string{"1.2.3.4"}) {
+		t.Errorf("Wrong result: %v", addrs)
+	}
+}
@@ -0,0 +1,62 @@
+package mockdns
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// serverCookie returns the server cookie (RFC 7873) for the client cookie
+// and IP address, hex-encoded.
+func (s *Server) serverCookie(client string, ip net.IP) string {
+	mac := hmac.New(sha256.New, s.cookieSecret[:])
+	mac.Write([]byte(strings.ToLower(client)))
+	mac.Write(ip.To16())
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// checkCookie handles the DNS COOKIE option in the query. The option with
+// the valid server cookie is added to the reply.
+//
+// If the query should not be answered, the error response is
+// written and false is returned.
+func (s *Server) checkCookie(w dns.ResponseWriter, req, reply *dns.Msg) bool {
+	o := ednsOption(req, dns.EDNS0COOKIE)
+	if o == nil {
+		if s.RequireCookie && s.RefuseNoCookie {
+			reply.SetRcode(req, dns.RcodeRefused)
+			s.writeMsg(w, req, reply)
+			return false
+		}
+		return true
+	}
+
+	cookie, ok := o.(*dns.EDNS0_COOKIE)
+	// Client cookie is 8 bytes, server cookie is 8 to 32 bytes.
+	if !ok || len(cookie.Cookie) < 16 || (len(cookie.Cookie) > 16 && len(cookie.Cookie) < 32) || len(cookie.Cookie) > 80 {
+		reply.SetRcode(req, dns.RcodeFormatError)
+		s.writeMsg(w, req, reply)
+		return false
+	}
+
+	client := cookie.Cookie[:16]
+	valid := s.serverCookie(client, remoteIP(w))
+
+	opt := setEdns0(req, reply)
+	opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{
+		Code:   dns.EDNS0COOKIE,
+		Cookie: client + valid,
+	})
+
+	if s.RequireCookie && !strings.EqualFold(cookie.Cookie[16:], valid) {
+		reply.Rcode = dns.RcodeBadCookie
+		s.writeMsg(w, req, reply)
+		return false
+	}
+
+	return true
+}
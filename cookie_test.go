@@ -0,0 +1,133 @@
+package mockdns
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestServer_RequireCookie(t *testing.T) {
+	srv, err := NewServer(map[string]Zone{
+		"example.org.": {
+			A: []string{"1.2.3.4"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.RequireCookie = true
+
+	const clientCookie = "0123456789abcdef"
+
+	query := func(cookie string) *dns.Msg {
+		t.Helper()
+
+		msg := new(dns.Msg)
+		msg.SetQuestion("example.org.", dns.TypeA)
+		if cookie != "" {
+			msg.SetEdns0(4096, false)
+			opt := msg.IsEdns0()
+			opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{
+				Code:   dns.EDNS0COOKIE,
+				Cookie: cookie,
+			})
+		}
+		reply, err := srv.Exchange(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return reply
+	}
+	replyCookie := func(reply *dns.Msg) string {
+		t.Helper()
+
+		if opt := reply.IsEdns0(); opt != nil {
+			for _, o := range opt.Option {
+				if o, ok := o.(*dns.EDNS0_COOKIE); ok {
+					return o.Cookie
+				}
+			}
+		}
+		t.Fatal("No COOKIE option in response")
+		return ""
+	}
+
+	// Client cookie only - BADCOOKIE with the server cookie to use.
+	reply := query(clientCookie)
+	if reply.Rcode != dns.RcodeBadCookie {
+		t.Fatalf("Wrong rcode, want BADCOOKIE, got %v", dns.RcodeToString[reply.Rcode])
+	}
+	if len(reply.Answer) != 0 {
+		t.Errorf("BADCOOKIE response contains answers")
+	}
+	fullCookie := replyCookie(reply)
+	if len(fullCookie) != 32 || fullCookie[:16] != clientCookie {
+		t.Fatalf("Wrong cookie in response: %v", fullCookie)
+	}
+
+	// Valid server cookie.
+	reply = query(fullCookie)
+	if reply.Rcode != dns.RcodeSuccess || len(reply.Answer) != 1 {
+		t.Fatalf("Query with valid cookie is not answered: %v", reply)
+	}
+	if c := replyCookie(reply); c != fullCookie {
+		t.Errorf("Server cookie changed: %v != %v", c, fullCookie)
+	}
+
+	// Invalid server cookie.
+	reply = query(clientCookie + "0000000000000000")
+	if reply.Rcode != dns.RcodeBadCookie {
+		t.Errorf("Wrong rcode, want BADCOOKIE, got %v", dns.RcodeToString[reply.Rcode])
+	}
+
+	// Server cookie is bound to the client cookie.
+	reply = query("fedcba9876543210" + fullCookie[16:])
+	if reply.Rcode != dns.RcodeBadCookie {
+		t.Errorf("Wrong rcode, want BADCOOKIE, got %v", dns.RcodeToString[reply.Rcode])
+	}
+
+	// No cookie.
+	reply = query("")
+	if reply.Rcode != dns.RcodeSuccess || len(reply.Answer) != 1 {
+		t.Errorf("Query without cookie is not answered: %v", reply)
+	}
+	srv.RefuseNoCookie = true
+	reply = query("")
+	if reply.Rcode != dns.RcodeRefused {
+		t.Errorf("Wrong rcode, want REFUSED, got %v", dns.RcodeToString[reply.Rcode])
+	}
+}
+
+func TestServer_RequireCookie_AnswerOnly(t *testing.T) {
+	srv := NewUnstartedServer(map[string]Zone{
+		"example.org.": {
+			A: []string{"1.2.3.4"},
+		},
+	})
+	srv.RequireCookie = true
+	srv.AnswerOnly = true
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.org.", dns.TypeA)
+	msg.SetEdns0(4096, false)
+	opt := msg.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{
+		Code:   dns.EDNS0COOKIE,
+		Cookie: "0123456789abcdef",
+	})
+
+	cl := dns.Client{Timeout: time.Second}
+	reply, _, err := cl.Exchange(msg, srv.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Rcode != dns.RcodeBadCookie {
+		t.Errorf("Wrong rcode, want BADCOOKIE, got %v", dns.RcodeToString[reply.Rcode])
+	}
+}
@@ -0,0 +1,77 @@
+package mockdns
+
+import (
+	"sort"
+	"strings"
+)
+
+// DiffZones returns the human-readable difference between zone maps a and
+// b, one record per line. Records only present in a are prefixed with "- "
+// and records only present in b are prefixed with "+ ". Changed records are
+// shown as removed and then added.
+//
+// Lines are grouped by name and sorted, so the output is deterministic.
+// Only static records (see Zone) are compared. Empty string is returned if
+// there are no differences.
+func DiffZones(a, b map[string]Zone) string {
+	names := make(map[string]struct{}, len(a)+len(b))
+	for name := range a {
+		names[name] = struct{}{}
+	}
+	for name := range b {
+		names[name] = struct{}{}
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	var sb strings.Builder
+	for _, name := range sorted {
+		removed, added := diffRecords(zoneStrings(name, a[name]), zoneStrings(name, b[name]))
+		for _, rr := range removed {
+			sb.WriteString("- " + rr + "\n")
+		}
+		for _, rr := range added {
+			sb.WriteString("+ " + rr + "\n")
+		}
+	}
+	return sb.String()
+}
+
+// zoneStrings returns the records of the zone in text form.
+func zoneStrings(name string, z Zone) []string {
+	rrs := zoneRRs(name, z)
+	strs := make([]string, 0, len(rrs))
+	for _, rr := range rrs {
+		strs = append(strs, rr.String())
+	}
+	return strs
+}
+
+// diffRecords returns sorted records that are present only in a and only
+// in b. Duplicate records are counted.
+func diffRecords(a, b []string) (onlyA, onlyB []string) {
+	count := make(map[string]int, len(a))
+	for _, rr := range a {
+		count[rr]++
+	}
+	for _, rr := range b {
+		if count[rr] > 0 {
+			count[rr]--
+			continue
+		}
+		onlyB = append(onlyB, rr)
+	}
+	for _, rr := range a {
+		if count[rr] > 0 {
+			count[rr]--
+			onlyA = append(onlyA, rr)
+		}
+	}
+
+	sort.Strings(onlyA)
+	sort.Strings(onlyB)
+	return onlyA, onlyB
+}
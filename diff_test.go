@@ -0,0 +1,39 @@
+package mockdns
+
+import (
+	"net"
+	"testing"
+)
+
+func TestDiffZones(t *testing.T) {
+	a := map[string]Zone{
+		"example.org.": {
+			A:  []string{"1.2.3.4", "1.2.3.5"},
+			MX: []net.MX{{Host: "mx.example.org.", Pref: 10}},
+		},
+		"old.example.org.": {
+			TXT: []string{"bye"},
+		},
+	}
+	b := map[string]Zone{
+		"example.org.": {
+			A:  []string{"1.2.3.5", "1.2.3.6"},
+			MX: []net.MX{{Host: "mx.example.org.", Pref: 10}},
+		},
+		"new.example.org.": {
+			CNAME: "example.org.",
+		},
+	}
+
+	want := "- example.org.\t9999\tIN\tA\t1.2.3.4\n" +
+		"+ example.org.\t9999\tIN\tA\t1.2.3.6\n" +
+		"+ new.example.org.\t9999\tIN\tCNAME\texample.org.\n" +
+		"- old.example.org.\t9999\tIN\tTXT\t\"bye\"\n"
+	if diff := DiffZones(a, b); diff != want {
+		t.Errorf("Wrong diff, want:\n%s\ngot:\n%s", want, diff)
+	}
+
+	if diff := DiffZones(a, a); diff != "" {
+		t.Errorf("Non-empty diff for equal zones:\n%s", diff)
+	}
+}
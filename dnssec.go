@@ -0,0 +1,78 @@
+package mockdns
+
+import (
+	"context"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// isDNSSECType reports whether records of type t are included in responses
+// only if the query has the DO flag set (RFC 4035, section 3.2.1).
+func isDNSSECType(t uint16) bool {
+	switch t {
+	case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+		return true
+	}
+	return false
+}
+
+// dnssecOK reports whether the query has the EDNS DO flag set.
+func dnssecOK(req *dns.Msg) bool {
+	opt := req.IsEdns0()
+	return opt != nil && opt.Do()
+}
+
+// gateDNSSEC adds signatures of the answer records to reply if the query has
+// the DO flag set. Otherwise, it removes DNSSEC records from reply, except
+// for records of the queried type.
+func (s *Server) gateDNSSEC(ctx context.Context, req, reply *dns.Msg, qtype uint16) {
+	if dnssecOK(req) {
+		if qtype != dns.TypeANY && qtype != dns.TypeRRSIG {
+			s.addSignatures(ctx, reply)
+		}
+		return
+	}
+
+	reply.Answer = stripDNSSEC(reply.Answer, qtype)
+	reply.Ns = stripDNSSEC(reply.Ns, 0)
+	reply.Extra = stripDNSSEC(reply.Extra, 0)
+}
+
+// stripDNSSEC returns rrs without DNSSEC records other than of type keep.
+func stripDNSSEC(rrs []dns.RR, keep uint16) []dns.RR {
+	var kept []dns.RR
+	for _, rr := range rrs {
+		if t := rr.Header().Rrtype; t != keep && isDNSSECType(t) {
+			continue
+		}
+		kept = append(kept, rr)
+	}
+	return kept
+}
+
+// addSignatures adds RRSIG records from Zone.Misc covering the records in the
+// answer section of reply.
+func (s *Server) addSignatures(ctx context.Context, reply *dns.Msg) {
+	type rrset struct {
+		name   string
+		rrtype uint16
+	}
+	zones := s.r.zones(ctx)
+	signed := make(map[rrset]struct{})
+	var sigs []dns.RR
+	for _, rr := range reply.Answer {
+		set := rrset{strings.ToLower(rr.Header().Name), rr.Header().Rrtype}
+		if _, ok := signed[set]; ok {
+			continue
+		}
+		signed[set] = struct{}{}
+
+		for _, sig := range zones[set.name].Misc[dns.Type(dns.TypeRRSIG)] {
+			if sig, ok := sig.(*dns.RRSIG); ok && sig.TypeCovered == set.rrtype {
+				sigs = append(sigs, sig)
+			}
+		}
+	}
+	reply.Answer = append(reply.Answer, sigs...)
+}
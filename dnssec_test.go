@@ -0,0 +1,84 @@
+package mockdns
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestServer_DNSSECGating(t *testing.T) {
+	mustRR := func(s string) dns.RR {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rr
+	}
+
+	srv, err := NewServer(map[string]Zone{
+		"example.org.": Zone{
+			A:   []string{"1.2.3.4"},
+			TXT: []string{"hello"},
+			Misc: map[dns.Type][]dns.RR{
+				dns.Type(dns.TypeRRSIG): {
+					mustRR("example.org. 9999 IN RRSIG A 13 2 9999 20300101000000 20200101000000 12345 example.org. c2lnbmF0dXJl"),
+					mustRR("example.org. 9999 IN RRSIG TXT 13 2 9999 20300101000000 20200101000000 12345 example.org. c2lnbmF0dXJl"),
+				},
+				dns.Type(dns.TypeNSEC): {
+					mustRR("example.org. 9999 IN NSEC www.example.org. A TXT RRSIG NSEC"),
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	query := func(qtype uint16, do bool) map[uint16]int {
+		t.Helper()
+		msg := new(dns.Msg)
+		msg.SetQuestion("example.org.", qtype)
+		msg.SetEdns0(4096, do)
+		reply, err := srv.Exchange(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		types := make(map[uint16]int)
+		for _, rr := range reply.Answer {
+			types[rr.Header().Rrtype]++
+		}
+		for _, rr := range reply.Ns {
+			if isDNSSECType(rr.Header().Rrtype) {
+				t.Errorf("DNSSEC record in authority section: %v", rr)
+			}
+		}
+		return types
+	}
+
+	cases := []struct {
+		qtype uint16
+		do    bool
+		rrsig int
+		nsec  int
+	}{
+		{dns.TypeA, false, 0, 0},
+		{dns.TypeA, true, 1, 0},
+		{dns.TypeTXT, true, 1, 0},
+		{dns.TypeANY, false, 0, 0},
+		{dns.TypeANY, true, 2, 1},
+		{dns.TypeRRSIG, false, 2, 0},
+		{dns.TypeNSEC, false, 0, 1},
+	}
+	for _, c := range cases {
+		types := query(c.qtype, c.do)
+		if types[dns.TypeRRSIG] != c.rrsig || types[dns.TypeNSEC] != c.nsec {
+			t.Errorf("%s DO=%v: want %d RRSIG and %d NSEC, got %v",
+				dns.TypeToString[c.qtype], c.do, c.rrsig, c.nsec, types)
+		}
+	}
+
+	if types := query(dns.TypeA, true); types[dns.TypeA] != 1 {
+		t.Errorf("Wrong answer: %v", types)
+	}
+}
@@ -0,0 +1,86 @@
+package mockdns
+
+import (
+	"github.com/miekg/dns"
+)
+
+// setEdns0 adds the OPT record to reply if the query has one and returns it.
+// nil is returned if the query does not use EDNS.
+func setEdns0(req, reply *dns.Msg) *dns.OPT {
+	reqOpt := req.IsEdns0()
+	if reqOpt == nil {
+		return nil
+	}
+	if opt := reply.IsEdns0(); opt != nil {
+		return opt
+	}
+
+	reply.SetEdns0(4096, reqOpt.Do())
+	return reply.IsEdns0()
+}
+
+// ednsOption returns the EDNS option with the specified code from the query.
+func ednsOption(req *dns.Msg, code uint16) dns.EDNS0 {
+	opt := req.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if o.Option() == code {
+			return o
+		}
+	}
+	return nil
+}
+
+// addExpire adds the EDNS EXPIRE option (RFC 7314) to the reply if it is
+// requested. The reported value is the SOA expire timer minus the time passed
+// since Server.ExpireStart.
+func (s *Server) addExpire(req, reply *dns.Msg) {
+	if ednsOption(req, dns.EDNS0EXPIRE) == nil {
+		return
+	}
+
+	var soa *dns.SOA
+	for _, rr := range reply.Answer {
+		if rr, ok := rr.(*dns.SOA); ok {
+			soa = rr
+			break
+		}
+	}
+	if soa == nil {
+		return
+	}
+
+	expire := soa.Expire
+	if !s.ExpireStart.IsZero() {
+		elapsed := s.r.now().Sub(s.ExpireStart).Seconds()
+		if elapsed >= float64(expire) {
+			expire = 0
+		} else if elapsed > 0 {
+			expire -= uint32(elapsed)
+		}
+	}
+
+	opt := setEdns0(req, reply)
+	opt.Option = append(opt.Option, &dns.EDNS0_EXPIRE{
+		Code:   dns.EDNS0EXPIRE,
+		Expire: expire,
+	})
+}
+
+// addEDE adds the Extended DNS Error option (RFC 8914) to the reply if
+// ede is not nil and the query uses EDNS.
+func addEDE(req, reply *dns.Msg, ede *dns.EDNS0_EDE) {
+	if ede == nil {
+		return
+	}
+	opt := setEdns0(req, reply)
+	if opt == nil {
+		return
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_EDE{
+		InfoCode:  ede.InfoCode,
+		ExtraText: ede.ExtraText,
+	})
+}
@@ -0,0 +1,148 @@
+package mockdns
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestServer_EDNSExpire(t *testing.T) {
+	now := time.Date(2020, 5, 31, 0, 0, 0, 0, time.UTC)
+	srv, err := NewServer(map[string]Zone{
+		"example.org.": {
+			A: []string{"1.2.3.4"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.Resolver().Now = func() time.Time { return now }
+	srv.ExpireStart = now
+
+	query := func(qtype uint16, expire bool) *dns.Msg {
+		t.Helper()
+
+		msg := new(dns.Msg)
+		msg.SetQuestion("example.org.", qtype)
+		msg.SetEdns0(4096, false)
+		if expire {
+			opt := msg.IsEdns0()
+			opt.Option = append(opt.Option, &dns.EDNS0_EXPIRE{Code: dns.EDNS0EXPIRE})
+		}
+		reply, err := srv.Exchange(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reply.IsEdns0() == nil {
+			t.Fatal("No OPT record in response")
+		}
+		return reply
+	}
+	expireOpt := func(reply *dns.Msg) *dns.EDNS0_EXPIRE {
+		for _, o := range reply.IsEdns0().Option {
+			if o, ok := o.(*dns.EDNS0_EXPIRE); ok {
+				return o
+			}
+		}
+		return nil
+	}
+
+	if opt := expireOpt(query(dns.TypeSOA, false)); opt != nil {
+		t.Error("EXPIRE option is present when not requested")
+	}
+	if opt := expireOpt(query(dns.TypeA, true)); opt != nil {
+		t.Error("EXPIRE option is present in A response")
+	}
+
+	// Default SOA expire is 1800.
+	for _, step := range []struct {
+		elapsed time.Duration
+		want    uint32
+	}{
+		{0, 1800},
+		{10 * time.Minute, 1200},
+		{30 * time.Minute, 0},
+		{24 * time.Hour, 0},
+	} {
+		now = srv.ExpireStart.Add(step.elapsed)
+		opt := expireOpt(query(dns.TypeSOA, true))
+		if opt == nil {
+			t.Fatal("No EXPIRE option in SOA response")
+		}
+		if opt.Expire != step.want {
+			t.Errorf("After %v: wrong EXPIRE value, want %v, got %v", step.elapsed, step.want, opt.Expire)
+		}
+	}
+}
+
+func TestServer_EDE(t *testing.T) {
+	srv, err := NewServer(map[string]Zone{
+		"example.org.": {
+			A: []string{"1.2.3.4"},
+			EDE: &dns.EDNS0_EDE{
+				InfoCode:  dns.ExtendedErrorCodeForgedAnswer,
+				ExtraText: "blocked by policy",
+			},
+		},
+		"example.net.": {
+			Err: errors.New("network error"),
+			EDE: &dns.EDNS0_EDE{
+				InfoCode: dns.ExtendedErrorCodeNetworkError,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	query := func(name string, edns bool) *dns.Msg {
+		t.Helper()
+
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeA)
+		if edns {
+			msg.SetEdns0(4096, false)
+		}
+		reply, err := srv.Exchange(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return reply
+	}
+	ede := func(reply *dns.Msg) *dns.EDNS0_EDE {
+		opt := reply.IsEdns0()
+		if opt == nil {
+			return nil
+		}
+		for _, o := range opt.Option {
+			if o, ok := o.(*dns.EDNS0_EDE); ok {
+				return o
+			}
+		}
+		return nil
+	}
+
+	reply := query("example.org.", true)
+	if reply.Rcode != dns.RcodeSuccess || len(reply.Answer) != 1 {
+		t.Fatalf("Wrong response: %v", reply)
+	}
+	if e := ede(reply); e == nil || e.InfoCode != dns.ExtendedErrorCodeForgedAnswer || e.ExtraText != "blocked by policy" {
+		t.Errorf("Wrong EDE in positive response: %v", e)
+	}
+
+	if reply := query("example.org.", false); reply.IsEdns0() != nil {
+		t.Errorf("OPT is present in response to non-EDNS query")
+	}
+
+	reply = query("example.net.", true)
+	if reply.Rcode != dns.RcodeServerFailure {
+		t.Fatalf("Wrong rcode, want SERVFAIL, got %v", dns.RcodeToString[reply.Rcode])
+	}
+	if e := ede(reply); e == nil || e.InfoCode != dns.ExtendedErrorCodeNetworkError {
+		t.Errorf("Wrong EDE in SERVFAIL response: %v", e)
+	}
+}
@@ -0,0 +1,126 @@
+package mockdns
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// addTXT appends the TXT record to the zone for name, creating it if needed.
+func (r *Resolver) addTXT(name, txt string) {
+	r.updateZone(name, func(z *Zone) { z.TXT = append(z.TXT, txt) })
+}
+
+// updateZone calls f to modify the zone for name, creating it if needed.
+func (r *Resolver) updateZone(name string, f func(z *Zone)) {
+	if r.Zones == nil {
+		r.Zones = make(map[string]Zone)
+	}
+
+	name = strings.ToLower(dns.Fqdn(name))
+	zone := r.Zones[name]
+	f(&zone)
+	r.Zones[name] = zone
+}
+
+// AddDMARC adds the DMARC policy record for domain (at _dmarc.domain).
+// policy is the value for the "p" tag, e.g. "reject".
+func (r *Resolver) AddDMARC(domain, policy string) {
+	r.addTXT("_dmarc."+domain, "v=DMARC1; p="+policy)
+}
+
+// AddDKIM adds the DKIM public key record for the specified selector and
+// domain (at selector._domainkey.domain). key is the base64-encoded public
+// key, the value for the "p" tag.
+func (r *Resolver) AddDKIM(selector, domain, key string) {
+	r.addTXT(selector+"._domainkey."+domain, "v=DKIM1; p="+key)
+}
+
+// TLSA is the certificate association data of TLSA (RFC 6698) and SMIMEA
+// (RFC 8162) records.
+type TLSA struct {
+	Usage        uint8
+	Selector     uint8
+	MatchingType uint8
+
+	// Certificate is the hex-encoded certificate association data.
+	Certificate string
+}
+
+// OPENPGPKEYName returns the owner name of the OPENPGPKEY record for the
+// email address (RFC 7929, section 3).
+func OPENPGPKEYName(email string) (string, error) {
+	return hashedOwner(email, "_openpgpkey")
+}
+
+// SMIMEAName returns the owner name of the SMIMEA record for the email
+// address (RFC 8162, section 3).
+func SMIMEAName(email string) (string, error) {
+	return hashedOwner(email, "_smimecert")
+}
+
+// hashedOwner returns the owner name consisting of the SHA-256 hash of the
+// email localpart truncated to 28 octets, the label and the email domain.
+// The localpart is hashed as is, without case folding.
+func hashedOwner(email, label string) (string, error) {
+	at := strings.LastIndex(email, "@")
+	if at <= 0 || at == len(email)-1 {
+		return "", errors.New("mockdns: malformed email address: " + email)
+	}
+
+	sum := sha256.Sum256([]byte(email[:at]))
+	return strings.ToLower(hex.EncodeToString(sum[:28]) + "." + label + "." + dns.Fqdn(email[at+1:])), nil
+}
+
+// AddOPENPGPKEY adds the OPENPGPKEY record with the base64-encoded key for
+// the email address.
+func (r *Resolver) AddOPENPGPKEY(email, key string) error {
+	name, err := OPENPGPKEYName(email)
+	if err != nil {
+		return err
+	}
+	r.updateZone(name, func(z *Zone) { z.OPENPGPKEY = append(z.OPENPGPKEY, key) })
+	return nil
+}
+
+// AddSMIMEA adds the SMIMEA record for the email address.
+func (r *Resolver) AddSMIMEA(email string, cert TLSA) error {
+	name, err := SMIMEAName(email)
+	if err != nil {
+		return err
+	}
+	r.updateZone(name, func(z *Zone) { z.SMIMEA = append(z.SMIMEA, cert) })
+	return nil
+}
+
+// openpgpkeyRRs returns OPENPGPKEY records of the zone with the specified
+// owner name.
+func openpgpkeyRRs(owner string, z Zone) []dns.RR {
+	rrs := make([]dns.RR, 0, len(z.OPENPGPKEY))
+	for _, key := range z.OPENPGPKEY {
+		rrs = append(rrs, &dns.OPENPGPKEY{
+			Hdr:       z.hdr(owner, dns.TypeOPENPGPKEY),
+			PublicKey: key,
+		})
+	}
+	return rrs
+}
+
+// smimeaRRs returns SMIMEA records of the zone with the specified owner
+// name.
+func smimeaRRs(owner string, z Zone) []dns.RR {
+	rrs := make([]dns.RR, 0, len(z.SMIMEA))
+	for _, cert := range z.SMIMEA {
+		rrs = append(rrs, &dns.SMIMEA{
+			Hdr:          z.hdr(owner, dns.TypeSMIMEA),
+			Usage:        cert.Usage,
+			Selector:     cert.Selector,
+			MatchingType: cert.MatchingType,
+			Certificate:  cert.Certificate,
+		})
+	}
+	return rrs
+}
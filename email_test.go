@@ -0,0 +1,130 @@
+package mockdns
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestResolver_UnderscoreLabels(t *testing.T) {
+	longSelector := strings.Repeat("s", 63)
+	key := strings.Repeat("A", 400)
+
+	var r Resolver
+	r.AddDMARC("Example.org", "reject")
+	r.AddDKIM("sel", "example.org.", key)
+	r.AddDKIM(longSelector, "example.org", key)
+
+	test := func(t *testing.T, lookupTXT func(ctx context.Context, name string) ([]string, error)) {
+		txt, err := lookupTXT(context.Background(), "_dmarc.example.org")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{"v=DMARC1; p=reject"}; !reflect.DeepEqual(txt, want) {
+			t.Errorf("Wrong DMARC record, want %v, got %v", want, txt)
+		}
+
+		for _, sel := range []string{"sel", "SEL", longSelector} {
+			txt, err = lookupTXT(context.Background(), sel+"._domainkey.example.org.")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := []string{"v=DKIM1; p=" + key}; !reflect.DeepEqual(txt, want) {
+				t.Errorf("Wrong DKIM record for %s, want %v, got %v", sel, want, txt)
+			}
+		}
+	}
+
+	t.Run("Resolver", func(t *testing.T) {
+		test(t, r.LookupTXT)
+	})
+	t.Run("Server", func(t *testing.T) {
+		srv, err := NewServer(r.Zones)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer srv.Close()
+
+		var netR net.Resolver
+		srv.PatchNet(&netR)
+		test(t, netR.LookupTXT)
+	})
+}
+
+func TestHashedOwnerNames(t *testing.T) {
+	// RFC 7929, section 3.
+	name, err := OPENPGPKEYName("hugh@Example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "c93f1e400f26708f98cb19d936620da35eec8f72e57f9eec01c1afd6._openpgpkey.example.com."; name != want {
+		t.Errorf("Wrong OPENPGPKEY name\nwant %s\n got %s", want, name)
+	}
+
+	name, err = SMIMEAName("hugh@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "c93f1e400f26708f98cb19d936620da35eec8f72e57f9eec01c1afd6._smimecert.example.com."; name != want {
+		t.Errorf("Wrong SMIMEA name\nwant %s\n got %s", want, name)
+	}
+
+	// Localpart is case-sensitive.
+	if upper, _ := SMIMEAName("Hugh@example.com"); upper == name {
+		t.Error("Localpart is case-folded")
+	}
+
+	for _, email := range []string{"hugh", "@example.com", "hugh@"} {
+		if _, err := OPENPGPKEYName(email); err == nil {
+			t.Errorf("No error for %q", email)
+		}
+	}
+}
+
+func TestServer_EmailKeys(t *testing.T) {
+	srv, err := NewServer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	cert := TLSA{Usage: 3, Selector: 1, MatchingType: 1, Certificate: strings.Repeat("ab", 32)}
+	if err := srv.Resolver().AddOPENPGPKEY("hugh@example.com", "AQID"); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Resolver().AddSMIMEA("hugh@example.com", cert); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name  func(string) (string, error)
+		qtype uint16
+		want  string
+	}{
+		{OPENPGPKEYName, dns.TypeOPENPGPKEY, "AQID"},
+		{SMIMEAName, dns.TypeSMIMEA, "3 1 1 " + cert.Certificate},
+	}
+	for _, c := range cases {
+		name, err := c.name("hugh@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, c.qtype)
+		reply, err := srv.Exchange(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(reply.Answer) != 1 {
+			t.Fatalf("%s: wrong amount of records in response: %v", dns.TypeToString[c.qtype], reply.Answer)
+		}
+		rr := reply.Answer[0]
+		if got := strings.TrimPrefix(rr.String(), rr.Header().String()); got != c.want {
+			t.Errorf("%s: want %q, got %q", dns.TypeToString[c.qtype], c.want, got)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package mockdns
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// memWriter is the dns.ResponseWriter that stores the written message
+// in memory.
+type memWriter struct {
+	local  net.Addr
+	remote net.Addr
+	reply  []byte
+}
+
+func (w *memWriter) LocalAddr() net.Addr {
+	return w.local
+}
+
+func (w *memWriter) RemoteAddr() net.Addr {
+	return w.remote
+}
+
+func (w *memWriter) WriteMsg(m *dns.Msg) error {
+	b, err := m.Pack()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+func (w *memWriter) Write(b []byte) (int, error) {
+	w.reply = append([]byte(nil), b...)
+	return len(b), nil
+}
+
+func (w *memWriter) Close() error {
+	return nil
+}
+
+func (w *memWriter) TsigStatus() error {
+	return nil
+}
+
+func (w *memWriter) TsigTimersOnly(bool) {}
+
+func (w *memWriter) Hijack() {}
+
+// Exchange passes the query m to the server handler directly, without
+// using the network, and returns the response. The response is packed and
+// unpacked as it would be when sent over UDP.
+func (s *Server) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	return s.exchange(&memWriter{
+		local:  s.LocalAddr(),
+		remote: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0},
+	}, m)
+}
+
+func (s *Server) exchange(w *memWriter, m *dns.Msg) (*dns.Msg, error) {
+	s.ServeDNS(w, m)
+
+	if w.reply == nil {
+		return nil, errors.New("mockdns: no response written")
+	}
+
+	reply := new(dns.Msg)
+	if err := reply.Unpack(w.reply); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// AnswerAll queries the server for each of the questions using Exchange and
+// returns the responses in the same order. The response is nil if it could
+// not be obtained.
+func (s *Server) AnswerAll(questions []dns.Question) []*dns.Msg {
+	replies := make([]*dns.Msg, 0, len(questions))
+	for _, q := range questions {
+		msg := new(dns.Msg)
+		msg.SetQuestion(q.Name, q.Qtype)
+		if q.Qclass != 0 {
+			msg.Question[0].Qclass = q.Qclass
+		}
+
+		reply, err := s.Exchange(msg)
+		if err != nil {
+			s.Log.Printf("AnswerAll: %v: %v", q.String(), err)
+		}
+		replies = append(replies, reply)
+	}
+	return replies
+}
+
+// BuildResponse returns the response Server would send for the query q if z
+// was the zone for q.Name, without starting a server. The response is packed
+// and unpacked as it would be when sent over TCP, so it is not truncated.
+//
+// nil is returned if the response cannot be packed (e.g. records in z are
+// malformed).
+func BuildResponse(q dns.Question, z Zone) *dns.Msg {
+	s := &Server{
+		r: Resolver{
+			Zones: map[string]Zone{
+				strings.ToLower(dns.Fqdn(q.Name)): z,
+			},
+		},
+		Log:      log.New(ioutil.Discard, "", 0),
+		Compress: true,
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	defer s.cancel()
+
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(q.Name), q.Qtype)
+	if q.Qclass != 0 {
+		msg.Question[0].Qclass = q.Qclass
+	}
+
+	reply, err := s.exchange(&memWriter{
+		local:  &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53},
+		remote: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0},
+	}, msg)
+	if err != nil {
+		return nil
+	}
+	return reply
+}
@@ -0,0 +1,126 @@
+package mockdns
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestServer_AnswerAll(t *testing.T) {
+	srv, err := NewServer(map[string]Zone{
+		"example.org.": Zone{
+			A:   []string{"1.2.3.4"},
+			TXT: []string{"hello"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	replies := srv.AnswerAll([]dns.Question{
+		{Name: "example.org.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
+		{Name: "example.org.", Qtype: dns.TypeTXT},
+		{Name: "example.com.", Qtype: dns.TypeA},
+		{Name: "example.org.", Qtype: dns.TypeA, Qclass: dns.ClassCHAOS},
+	})
+	if len(replies) != 4 {
+		t.Fatal("Wrong amount of replies:", len(replies))
+	}
+
+	wantRcode := []int{dns.RcodeSuccess, dns.RcodeSuccess, dns.RcodeNameError, dns.RcodeNotImplemented}
+	wantAnswers := []int{1, 1, 0, 0}
+	for i, reply := range replies {
+		if reply == nil {
+			t.Fatalf("%d: nil reply", i)
+		}
+		if reply.Rcode != wantRcode[i] {
+			t.Errorf("%d: wrong rcode, want %v, got %v", i, dns.RcodeToString[wantRcode[i]], dns.RcodeToString[reply.Rcode])
+		}
+		if len(reply.Answer) != wantAnswers[i] {
+			t.Errorf("%d: wrong amount of records in response: %v", i, len(reply.Answer))
+		}
+	}
+
+	if a := replies[0].Answer[0].(*dns.A); a.A.String() != "1.2.3.4" {
+		t.Errorf("Wrong A record: %v", a)
+	}
+	if txt := replies[1].Answer[0].(*dns.TXT); txt.Txt[0] != "hello" {
+		t.Errorf("Wrong TXT record: %v", txt)
+	}
+
+	// Replies should not share state.
+	replies[0].Answer = nil
+	if replies[1].Answer == nil {
+		t.Error("Replies share state")
+	}
+}
+
+func TestBuildResponse(t *testing.T) {
+	reply := BuildResponse(dns.Question{Name: "example.org.", Qtype: dns.TypeA}, Zone{
+		A:  []string{"1.2.3.4"},
+		AD: true,
+	})
+	if reply == nil {
+		t.Fatal("No response")
+	}
+	if !reply.Response || !reply.RecursionAvailable || !reply.AuthenticatedData {
+		t.Errorf("Wrong flags: %v", reply.MsgHdr)
+	}
+	if len(reply.Question) != 1 || reply.Question[0].Name != "example.org." {
+		t.Errorf("Wrong question section: %v", reply.Question)
+	}
+	if len(reply.Answer) != 1 {
+		t.Fatal("Wrong amount of records in response:", reply.Answer)
+	}
+	if a, ok := reply.Answer[0].(*dns.A); !ok || a.A.String() != "1.2.3.4" || a.Hdr.Ttl != 9999 {
+		t.Errorf("Wrong answer record: %v", reply.Answer[0])
+	}
+
+	// Relative name
+	reply = BuildResponse(dns.Question{Name: "example.org", Qtype: dns.TypeA}, Zone{
+		A: []string{"1.2.3.4"},
+	})
+	if reply == nil {
+		t.Fatal("No response for relative name")
+	}
+	if len(reply.Question) != 1 || reply.Question[0].Name != "example.org." || len(reply.Answer) != 1 {
+		t.Errorf("Wrong response for relative name: %v", reply)
+	}
+
+	// NODATA
+	reply = BuildResponse(dns.Question{Name: "example.org.", Qtype: dns.TypeMX}, Zone{
+		A: []string{"1.2.3.4"},
+	})
+	if reply.Rcode != dns.RcodeSuccess || len(reply.Answer) != 0 || len(reply.Ns) != 1 {
+		t.Errorf("Wrong NODATA response: %v", reply)
+	}
+
+	// Error
+	reply = BuildResponse(dns.Question{Name: "example.org.", Qtype: dns.TypeA}, Zone{
+		Err: errors.New("broken"),
+	})
+	if reply.Rcode != dns.RcodeServerFailure {
+		t.Errorf("Wrong rcode, want SERVFAIL, got %v", dns.RcodeToString[reply.Rcode])
+	}
+
+	// CNAME to a name that does not exist.
+	reply = BuildResponse(dns.Question{Name: "example.org.", Qtype: dns.TypeA}, Zone{
+		CNAME: "example.com.",
+	})
+	if reply.Rcode != dns.RcodeNameError || len(reply.Answer) != 1 {
+		t.Errorf("Wrong NXDOMAIN response: %v", reply)
+	}
+
+	// Big responses are not truncated.
+	var zone Zone
+	for i := 0; i < 100; i++ {
+		zone.A = append(zone.A, fmt.Sprintf("10.0.0.%d", i))
+	}
+	reply = BuildResponse(dns.Question{Name: "example.org.", Qtype: dns.TypeA}, zone)
+	if reply.Truncated || len(reply.Answer) != 100 {
+		t.Errorf("Response is truncated: %v records", len(reply.Answer))
+	}
+}
@@ -0,0 +1,98 @@
+package mockdns
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+type queryKey struct {
+	qtype uint16
+	name  string
+}
+
+func (k queryKey) String() string {
+	return dns.TypeToString[k.qtype] + " " + k.name
+}
+
+// record stores the query for Verify.
+func (r *Resolver) record(qtype uint16, name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.queries == nil {
+		r.queries = make(map[queryKey]int)
+	}
+	r.queries[queryKey{qtype, strings.ToLower(dns.Fqdn(name))}]++
+}
+
+// QueryCount returns the number of queries of the specified type made for
+// name, including queries for names that do not exist (e.g. to check that
+// negative responses are cached by the client). If qtype is dns.TypeNone,
+// queries of all types are counted.
+//
+// Like for Verify, only the name initially queried is considered.
+func (r *Resolver) QueryCount(qtype uint16, name string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	name = strings.ToLower(dns.Fqdn(name))
+	if qtype != dns.TypeNone {
+		return r.queries[queryKey{qtype, name}]
+	}
+
+	count := 0
+	for key, n := range r.queries {
+		if key.name == name {
+			count += n
+		}
+	}
+	return count
+}
+
+// Expect declares that a query of the specified type for name is expected to
+// be made. Use Verify to check that the queries made match the expectations
+// exactly.
+//
+// Note that LookupHost and similar methods make both A and AAAA queries.
+func (r *Resolver) Expect(qtype uint16, name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.expected == nil {
+		r.expected = make(map[queryKey]struct{})
+	}
+	r.expected[queryKey{qtype, strings.ToLower(dns.Fqdn(name))}] = struct{}{}
+}
+
+// Verify fails the test if any query declared using Expect was not made or
+// if any query that was not declared was made.
+//
+// Only the name initially queried is considered, CNAME targets that
+// were followed are not.
+func (r *Resolver) Verify(tb testing.TB) {
+	tb.Helper()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var problems []string
+	for key := range r.expected {
+		if r.queries[key] == 0 {
+			problems = append(problems, fmt.Sprintf("\tmissing query: %v", key))
+		}
+	}
+	for key, count := range r.queries {
+		if _, ok := r.expected[key]; !ok {
+			problems = append(problems, fmt.Sprintf("\tunexpected query: %v (%d times)", key, count))
+		}
+	}
+
+	if len(problems) != 0 {
+		sort.Strings(problems)
+		tb.Errorf("DNS queries do not match expectations:\n%s", strings.Join(problems, "\n"))
+	}
+}
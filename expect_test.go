@@ -0,0 +1,103 @@
+package mockdns
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestResolver_Verify(t *testing.T) {
+	r := Resolver{Zones: map[string]Zone{
+		"example.org.": {
+			A:  []string{"1.2.3.4"},
+			MX: []net.MX{{Host: "mx.example.org.", Pref: 10}},
+		},
+	}}
+	r.Expect(dns.TypeA, "example.org")
+	r.Expect(dns.TypeAAAA, "example.org.")
+	r.Expect(dns.TypeMX, "example.com.")
+
+	r.LookupHost(context.Background(), "Example.org")
+	r.LookupMX(context.Background(), "example.org")
+
+	var ftb fakeTB
+	r.Verify(&ftb)
+	if len(ftb.failures) != 1 {
+		t.Fatalf("Expected one failure, got %v", ftb.failures)
+	}
+	want := "DNS queries do not match expectations:\n" +
+		"\tmissing query: MX example.com.\n" +
+		"\tunexpected query: MX example.org. (1 times)"
+	if ftb.failures[0] != want {
+		t.Errorf("Wrong failure message\nwant %q\n got %q", want, ftb.failures[0])
+	}
+
+	r.Expect(dns.TypeMX, "example.org")
+	r.LookupMX(context.Background(), "example.com")
+	r.Verify(t)
+}
+
+func TestServer_Verify(t *testing.T) {
+	srv, err := NewServer(map[string]Zone{
+		"example.org.": {
+			A: []string{"1.2.3.4"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	srv.Expect(dns.TypeA, "example.org.")
+	srv.Expect(dns.TypeAAAA, "example.org.")
+
+	var r net.Resolver
+	srv.PatchNet(&r)
+	if _, err := r.LookupHost(context.Background(), "example.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	srv.Verify(t)
+}
+
+func TestServer_QueryCount(t *testing.T) {
+	srv, err := NewServer(map[string]Zone{
+		"example.org.": {
+			TXT: []string{"hello"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	var r net.Resolver
+	srv.PatchNet(&r)
+	for i := 0; i < 3; i++ {
+		_, err := r.LookupHost(context.Background(), "missing.example.org")
+		AssertDNSError(t, err, DNSErrorSpec{IsNotFound: true})
+	}
+	if _, err := r.LookupTXT(context.Background(), "example.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		qtype uint16
+		name  string
+		want  int
+	}{
+		{dns.TypeA, "missing.example.org.", 3},
+		{dns.TypeAAAA, "Missing.Example.org", 3},
+		{dns.TypeNone, "missing.example.org.", 6},
+		{dns.TypeTXT, "missing.example.org.", 0},
+		{dns.TypeTXT, "example.org.", 1},
+		{dns.TypeNone, "other.example.org.", 0},
+	}
+	for _, c := range cases {
+		if n := srv.QueryCount(c.qtype, c.name); n != c.want {
+			t.Errorf("%s %s: want %d queries, got %d", dns.TypeToString[c.qtype], c.name, c.want, n)
+		}
+	}
+}
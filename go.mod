@@ -2,4 +2,4 @@ module github.com/foxcpp/go-mockdns
 
 go 1.13
 
-require github.com/miekg/dns v1.1.22
+require github.com/miekg/dns v1.1.42
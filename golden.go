@@ -0,0 +1,139 @@
+package mockdns
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// GoldenResponse returns the response the server sends for the query with
+// the question q, using Exchange. The query has the RD flag set and no EDNS
+// OPT record. nil is returned if the response could not be obtained.
+func (s *Server) GoldenResponse(q dns.Question) *dns.Msg {
+	return s.AnswerAll([]dns.Question{q})[0]
+}
+
+// GoldenOptions controls normalization of messages by NormalizeMsg and
+// AssertGolden.
+//
+// By default, the message ID is set to 0 and the EDNS PADDING (RFC 7830)
+// and COOKIE (RFC 7873) options are removed, as they differ between
+// otherwise identical responses. Everything else, including flags, TTLs and
+// the order of records, is compared as is.
+type GoldenOptions struct {
+	// KeepID disables resetting of the message ID.
+	KeepID bool
+
+	// KeepPadding disables removal of the EDNS PADDING option.
+	KeepPadding bool
+
+	// KeepCookie disables removal of the EDNS COOKIE option. Server cookies
+	// depend on a random secret, so they are never equal between servers.
+	KeepCookie bool
+
+	// IgnoreTTL sets the TTL of all records except OPT to 0.
+	IgnoreTTL bool
+}
+
+// NormalizeMsg returns a copy of m with volatile fields normalized as
+// specified by opts. m is not modified.
+func NormalizeMsg(m *dns.Msg, opts GoldenOptions) *dns.Msg {
+	m = m.Copy()
+	if !opts.KeepID {
+		m.Id = 0
+	}
+
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			if opt, ok := rr.(*dns.OPT); ok {
+				opt.Option = normalizeOptions(opt.Option, opts)
+				continue
+			}
+			if opts.IgnoreTTL {
+				rr.Header().Ttl = 0
+			}
+		}
+	}
+	return m
+}
+
+func normalizeOptions(options []dns.EDNS0, opts GoldenOptions) []dns.EDNS0 {
+	var kept []dns.EDNS0
+	for _, o := range options {
+		switch o.Option() {
+		case dns.EDNS0PADDING:
+			if !opts.KeepPadding {
+				continue
+			}
+		case dns.EDNS0COOKIE:
+			if !opts.KeepCookie {
+				continue
+			}
+		}
+		kept = append(kept, o)
+	}
+	return kept
+}
+
+// AssertGolden fails the test if got and want differ after normalization
+// with opts. Messages are compared both in text form, which is used to
+// report the differing lines, and in wire format, which also catches
+// differences not visible in text form (e.g. name compression).
+func AssertGolden(tb testing.TB, got, want *dns.Msg, opts GoldenOptions) {
+	tb.Helper()
+
+	if got == nil || want == nil {
+		if got != want {
+			tb.Errorf("Golden mismatch: got %v, want %v", got, want)
+		}
+		return
+	}
+
+	got, want = NormalizeMsg(got, opts), NormalizeMsg(want, opts)
+	if diff := diffLines(want.String(), got.String()); diff != "" {
+		tb.Errorf("Golden mismatch (- want, + got):\n%s", diff)
+		return
+	}
+
+	gotWire, err := got.Pack()
+	if err != nil {
+		tb.Errorf("Cannot pack message: %v", err)
+		return
+	}
+	wantWire, err := want.Pack()
+	if err != nil {
+		tb.Errorf("Cannot pack golden message: %v", err)
+		return
+	}
+	if string(gotWire) != string(wantWire) {
+		tb.Errorf("Golden mismatch in wire format:\nwant %x\n got %x", wantWire, gotWire)
+	}
+}
+
+// diffLines returns the lines that differ at the same positions in a and b,
+// prefixed with "- " and "+ " respectively.
+func diffLines(a, b string) string {
+	linesA, linesB := strings.Split(a, "\n"), strings.Split(b, "\n")
+
+	var sb strings.Builder
+	for i := 0; i < len(linesA) || i < len(linesB); i++ {
+		var lineA, lineB string
+		if i < len(linesA) {
+			lineA = linesA[i]
+		}
+		if i < len(linesB) {
+			lineB = linesB[i]
+		}
+		if lineA == lineB {
+			continue
+		}
+		if i < len(linesA) {
+			sb.WriteString("- " + lineA + "\n")
+		}
+		if i < len(linesB) {
+			sb.WriteString("+ " + lineB + "\n")
+		}
+	}
+	return sb.String()
+}
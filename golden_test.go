@@ -0,0 +1,62 @@
+package mockdns
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestAssertGolden(t *testing.T) {
+	srv, err := NewServer(map[string]Zone{
+		"example.org.": Zone{
+			A: []string{"1.2.3.4", "1.2.3.5"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	q := dns.Question{Name: "example.org.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	golden := srv.GoldenResponse(q)
+	if golden == nil {
+		t.Fatal("No response")
+	}
+
+	// IDs differ.
+	AssertGolden(t, srv.GoldenResponse(q), golden, GoldenOptions{})
+
+	padded := golden.Copy()
+	padded.SetEdns0(4096, false)
+	golden.SetEdns0(4096, false)
+	opt := padded.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_PADDING{Padding: make([]byte, 16)})
+	AssertGolden(t, padded, golden, GoldenOptions{})
+	if len(opt.Option) != 1 {
+		t.Error("Message is modified")
+	}
+
+	var ftb fakeTB
+	AssertGolden(&ftb, padded, golden, GoldenOptions{KeepPadding: true})
+	if len(ftb.failures) != 1 {
+		t.Fatalf("Expected one failure, got %v", ftb.failures)
+	}
+
+	reordered := golden.Copy()
+	reordered.Answer[0], reordered.Answer[1] = reordered.Answer[1], reordered.Answer[0]
+	ftb.failures = nil
+	AssertGolden(&ftb, reordered, golden, GoldenOptions{})
+	if len(ftb.failures) != 1 {
+		t.Fatalf("Expected one failure, got %v", ftb.failures)
+	}
+	t.Log(ftb.failures[0])
+
+	ttl := golden.Copy()
+	ttl.Answer[0].Header().Ttl = 1
+	AssertGolden(t, ttl, golden, GoldenOptions{IgnoreTTL: true})
+	ftb.failures = nil
+	AssertGolden(&ftb, ttl, golden, GoldenOptions{})
+	if len(ftb.failures) != 1 {
+		t.Fatalf("Expected one failure, got %v", ftb.failures)
+	}
+}
@@ -0,0 +1,73 @@
+package mockdns
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// ServerGroup is a set of Servers serving the same zones, like the
+// nameservers of a domain. It allows to simulate propagation of changes
+// that reach different nameservers at different times.
+type ServerGroup struct {
+	Servers []*Server
+
+	next uint32
+}
+
+// NewServerGroup starts n Servers, each serving its own copy of zones.
+func NewServerGroup(n int, zones map[string]Zone) (*ServerGroup, error) {
+	g := &ServerGroup{}
+	for i := 0; i < n; i++ {
+		zonesCpy := make(map[string]Zone, len(zones))
+		for name, z := range zones {
+			zonesCpy[name] = z
+		}
+
+		srv, err := NewServer(zonesCpy)
+		if err != nil {
+			g.Close()
+			return nil, err
+		}
+		g.Servers = append(g.Servers, srv)
+	}
+	return g, nil
+}
+
+// SetNow sets Resolver.Now for all servers in the group using
+// Resolver.SetNow, so it can be called while the servers are running.
+func (g *ServerGroup) SetNow(now func() time.Time) {
+	for _, srv := range g.Servers {
+		srv.Resolver().SetNow(now)
+	}
+}
+
+// Propagate schedules the change of the zone for name (see
+// Resolver.ScheduleChange) so that it reaches the first server at start and
+// each next server lag later than the previous one.
+func (g *ServerGroup) Propagate(name string, newZone Zone, start time.Time, lag time.Duration) {
+	for i, srv := range g.Servers {
+		srv.Resolver().ScheduleChange(name, start.Add(time.Duration(i)*lag), newZone)
+	}
+}
+
+// PatchNet configures net.Resolver instance to use servers of the group,
+// switching to the next server for each connection.
+//
+// Use UnpatchNet to revert changes.
+func (g *ServerGroup) PatchNet(r *net.Resolver) {
+	r.PreferGo = true
+	r.Dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		i := atomic.AddUint32(&g.next, 1) - 1
+		return g.Servers[int(i)%len(g.Servers)].dial(ctx, network)
+	}
+}
+
+// Close stops all servers in the group.
+func (g *ServerGroup) Close() error {
+	for _, srv := range g.Servers {
+		srv.Close()
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package mockdns
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestServerGroup_Propagate(t *testing.T) {
+	g, err := NewServerGroup(3, map[string]Zone{
+		"example.org.": {
+			A: []string{"1.1.1.1"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := start
+	g.SetNow(func() time.Time { return now })
+	g.Propagate("example.org", Zone{A: []string{"2.2.2.2"}}, start.Add(time.Minute), time.Minute)
+
+	addrs := func() []string {
+		t.Helper()
+		var res []string
+		for _, srv := range g.Servers {
+			msg := new(dns.Msg)
+			msg.SetQuestion("example.org.", dns.TypeA)
+			reply, err := srv.Exchange(msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res = append(res, reply.Answer[0].(*dns.A).A.String())
+		}
+		return res
+	}
+
+	cases := []struct {
+		at   time.Duration
+		want []string
+	}{
+		{0, []string{"1.1.1.1", "1.1.1.1", "1.1.1.1"}},
+		{90 * time.Second, []string{"2.2.2.2", "1.1.1.1", "1.1.1.1"}},
+		{150 * time.Second, []string{"2.2.2.2", "2.2.2.2", "1.1.1.1"}},
+		{3 * time.Minute, []string{"2.2.2.2", "2.2.2.2", "2.2.2.2"}},
+	}
+	for _, c := range cases {
+		now = start.Add(c.at)
+		if got := addrs(); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%v: want %v, got %v", c.at, c.want, got)
+		}
+	}
+}
+
+func TestServerGroup_PatchNet(t *testing.T) {
+	g := &ServerGroup{}
+	defer g.Close()
+	for _, txt := range []string{"first", "second"} {
+		srv, err := NewServer(map[string]Zone{
+			"example.org.": {
+				TXT: []string{txt},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		g.Servers = append(g.Servers, srv)
+	}
+
+	var r net.Resolver
+	g.PatchNet(&r)
+
+	seen := make(map[string]bool)
+	for i := 0; i < 4; i++ {
+		txt, err := r.LookupTXT(context.Background(), "example.org")
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen[txt[0]] = true
+	}
+	if !seen["first"] || !seen["second"] {
+		t.Errorf("Not all servers are queried: %v", seen)
+	}
+}
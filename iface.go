@@ -0,0 +1,35 @@
+package mockdns
+
+import (
+	"context"
+	"net"
+)
+
+// netResolver contains methods of net.Resolver that are implemented by
+// Resolver with the same signatures.
+type netResolver interface {
+	LookupAddr(ctx context.Context, addr string) (names []string, err error)
+	LookupCNAME(ctx context.Context, host string) (cname string, err error)
+	LookupHost(ctx context.Context, host string) (addrs []string, err error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupNS(ctx context.Context, name string) ([]*net.NS, error)
+	LookupPort(ctx context.Context, network, service string) (port int, err error)
+	LookupSRV(ctx context.Context, service, proto, name string) (cname string, addrs []*net.SRV, err error)
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// dialer contains methods of net.Dialer that are implemented by Resolver.
+type dialer interface {
+	Dial(network, addr string) (net.Conn, error)
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// Make sure Resolver stays a drop-in replacement for net.Resolver and
+// net.Dialer as methods are added.
+var (
+	_ netResolver = (*net.Resolver)(nil)
+	_ netResolver = (*Resolver)(nil)
+	_ dialer      = (*net.Dialer)(nil)
+	_ dialer      = (*Resolver)(nil)
+)
@@ -0,0 +1,117 @@
+package mockdns
+
+import (
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Overload specifies what Server does with queries exceeding MaxConcurrent.
+type Overload int
+
+const (
+	// OverloadWait makes excess queries wait until the number of queries
+	// being handled drops below Server.MaxConcurrent. If Server.QueueTimeout
+	// passes first, the query is REFUSED.
+	OverloadWait Overload = iota
+
+	// OverloadRefuse makes the server respond to excess queries with
+	// REFUSED immediately.
+	OverloadRefuse
+
+	// OverloadDrop makes the server ignore excess queries.
+	OverloadDrop
+)
+
+// Stats contains query handling statistics of a Server.
+type Stats struct {
+	// InFlight is the number of queries being handled at the moment.
+	InFlight int
+
+	// MaxInFlight is the highest InFlight value observed.
+	MaxInFlight int
+
+	// Refused and Dropped are the numbers of queries that were refused or
+	// dropped because of MaxConcurrent.
+	Refused int
+	Dropped int
+}
+
+// Stats returns query handling statistics. It is safe to call concurrently
+// with queries being handled.
+func (s *Server) Stats() Stats {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+	return s.stats
+}
+
+// acquire waits for the query handling slot according to MaxConcurrent and
+// Overload. If it returns false, the query should not be handled further,
+// the REFUSED response is already sent if needed. Otherwise, release must be
+// called once the query is handled.
+func (s *Server) acquire(w dns.ResponseWriter, req *dns.Msg) bool {
+	var timeout <-chan time.Time
+	for {
+		s.statsMu.Lock()
+		if s.MaxConcurrent <= 0 || s.stats.InFlight < s.MaxConcurrent {
+			s.stats.InFlight++
+			if s.stats.InFlight > s.stats.MaxInFlight {
+				s.stats.MaxInFlight = s.stats.InFlight
+			}
+			s.statsMu.Unlock()
+			return true
+		}
+
+		switch s.Overload {
+		case OverloadRefuse:
+			s.stats.Refused++
+			s.statsMu.Unlock()
+			s.refuse(w, req)
+			return false
+		case OverloadDrop:
+			s.stats.Dropped++
+			s.statsMu.Unlock()
+			return false
+		}
+
+		if s.released == nil {
+			s.released = make(chan struct{})
+		}
+		released := s.released
+		if timeout == nil && s.QueueTimeout > 0 {
+			timeout = time.After(s.QueueTimeout)
+		}
+		s.statsMu.Unlock()
+
+		select {
+		case <-released:
+		case <-timeout:
+			s.statsMu.Lock()
+			s.stats.Refused++
+			s.statsMu.Unlock()
+			s.refuse(w, req)
+			return false
+		case <-s.ctx.Done():
+			return false
+		}
+	}
+}
+
+// release frees the query handling slot taken by acquire and wakes up the
+// waiting queries.
+func (s *Server) release() {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+
+	s.stats.InFlight--
+	if s.released != nil {
+		close(s.released)
+		s.released = nil
+	}
+}
+
+func (s *Server) refuse(w dns.ResponseWriter, req *dns.Msg) {
+	reply := new(dns.Msg)
+	reply.SetRcode(req, dns.RcodeRefused)
+	s.writeMsg(w, req, reply)
+}
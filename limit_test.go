@@ -0,0 +1,136 @@
+package mockdns
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func exchangeConcurrently(t *testing.T, srv *Server, n int) []*dns.Msg {
+	t.Helper()
+
+	replies := make([]*dns.Msg, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			msg := new(dns.Msg)
+			msg.SetQuestion("example.org.", dns.TypeA)
+			replies[i], _ = srv.Exchange(msg)
+		}(i)
+	}
+	wg.Wait()
+	return replies
+}
+
+func TestServer_MaxConcurrent(t *testing.T) {
+	srv, err := NewServer(map[string]Zone{
+		"example.org.": {
+			A:     []string{"1.2.3.4"},
+			Delay: 100 * time.Millisecond,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.MaxConcurrent = 1
+
+	start := time.Now()
+	replies := exchangeConcurrently(t, srv, 3)
+	if time.Since(start) < 300*time.Millisecond {
+		t.Error("Queries are not handled one by one")
+	}
+	for i, reply := range replies {
+		if reply == nil || reply.Rcode != dns.RcodeSuccess {
+			t.Errorf("%d: wrong response: %v", i, reply)
+		}
+	}
+	if stats := srv.Stats(); stats.MaxInFlight != 1 || stats.InFlight != 0 {
+		t.Errorf("Wrong stats: %+v", stats)
+	}
+
+	srv.Overload = OverloadRefuse
+	refused := 0
+	for _, reply := range exchangeConcurrently(t, srv, 3) {
+		if reply != nil && reply.Rcode == dns.RcodeRefused {
+			refused++
+		}
+	}
+	if refused == 0 {
+		t.Error("No queries are refused")
+	}
+	if stats := srv.Stats(); stats.Refused != refused {
+		t.Errorf("Wrong stats, want %d refused: %+v", refused, stats)
+	}
+
+	srv.Overload = OverloadDrop
+	dropped := 0
+	for _, reply := range exchangeConcurrently(t, srv, 3) {
+		if reply == nil {
+			dropped++
+		}
+	}
+	if dropped == 0 {
+		t.Error("No queries are dropped")
+	}
+	if stats := srv.Stats(); stats.Dropped != dropped {
+		t.Errorf("Wrong stats, want %d dropped: %+v", dropped, stats)
+	}
+}
+
+func TestServer_MaxConcurrent_QueueTimeout(t *testing.T) {
+	srv, err := NewServer(map[string]Zone{
+		"example.org.": {
+			A:     []string{"1.2.3.4"},
+			Delay: 300 * time.Millisecond,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.MaxConcurrent = 1
+	srv.QueueTimeout = 50 * time.Millisecond
+
+	refused := 0
+	for _, reply := range exchangeConcurrently(t, srv, 2) {
+		if reply != nil && reply.Rcode == dns.RcodeRefused {
+			refused++
+		}
+	}
+	if refused != 1 {
+		t.Errorf("Wrong amount of refused queries: %d", refused)
+	}
+}
+
+func TestServer_MaxConcurrent_Close(t *testing.T) {
+	srv, err := NewServer(map[string]Zone{
+		"example.org.": {
+			A:     []string{"1.2.3.4"},
+			Delay: 5 * time.Second,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.MaxConcurrent = 1
+
+	done := make(chan struct{})
+	go func() {
+		exchangeConcurrently(t, srv, 3)
+		close(done)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	srv.Close()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Queries are not finished after Close")
+	}
+}
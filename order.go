@@ -0,0 +1,89 @@
+package mockdns
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Order specifies how records are ordered in lookup results.
+type Order int
+
+const (
+	// OrderAsIs returns records in the order they are listed in Zone. It
+	// is the default. Zones loaded using ParseZone and LoadZoneDir list
+	// records of each type in the file order.
+	OrderAsIs Order = iota
+
+	// OrderNameHash returns records in the order that is stable for each
+	// queried name but differs between names.
+	//
+	// The order is the permutation produced by math/rand source seeded
+	// using FNV-1a hash of the lowercase FQDN XOR'ed with Resolver.Seed.
+	OrderNameHash
+
+	// OrderRoundRobin rotates records by one position on each lookup of
+	// the same name and type.
+	OrderRoundRobin
+
+	// OrderShuffle returns records in random order, using Resolver.Rand.
+	//
+	// Each lookup shuffles the records as listed in Zone using
+	// Rand.Shuffle (Fisher-Yates), so with Rand seeded, the order returned
+	// by each lookup is fully determined by the seed and the number of
+	// shuffles done before it. Note that Rand is shared by all names and
+	// record types; lookups with less than two records do not use it.
+	OrderShuffle
+)
+
+// order returns the records reordered and limited according to the
+// Resolver configuration. addrs slice is not modified.
+func (r *Resolver) order(qtype uint16, name string, addrs []string) []string {
+	if len(addrs) == 0 {
+		return addrs
+	}
+
+	out := make([]string, len(addrs))
+	switch r.Order {
+	case OrderNameHash:
+		h := fnv.New64a()
+		h.Write([]byte(strings.ToLower(dns.Fqdn(name))))
+		rng := rand.New(rand.NewSource(int64(h.Sum64()) ^ r.Seed))
+		for i, j := range rng.Perm(len(addrs)) {
+			out[i] = addrs[j]
+		}
+	case OrderRoundRobin:
+		r.mu.Lock()
+		if r.rotation == nil {
+			r.rotation = make(map[queryKey]int)
+		}
+		key := queryKey{qtype, strings.ToLower(dns.Fqdn(name))}
+		shift := r.rotation[key] % len(addrs)
+		r.rotation[key]++
+		r.mu.Unlock()
+
+		n := copy(out, addrs[shift:])
+		copy(out[n:], addrs[:shift])
+	case OrderShuffle:
+		copy(out, addrs)
+
+		r.mu.Lock()
+		shuffle := rand.Shuffle
+		if r.Rand != nil {
+			shuffle = r.Rand.Shuffle
+		}
+		shuffle(len(out), func(i, j int) {
+			out[i], out[j] = out[j], out[i]
+		})
+		r.mu.Unlock()
+	default:
+		copy(out, addrs)
+	}
+
+	if r.Limit > 0 && len(out) > r.Limit {
+		out = out[:r.Limit]
+	}
+	return out
+}
@@ -0,0 +1,168 @@
+package mockdns
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestResolver_OrderNameHash(t *testing.T) {
+	zones := make(map[string]Zone)
+	var addrs []string
+	for i := 0; i < 10; i++ {
+		addrs = append(addrs, fmt.Sprintf("10.0.0.%d", i))
+	}
+	for i := 0; i < 10; i++ {
+		zones[fmt.Sprintf("host%d.example.org.", i)] = Zone{A: addrs}
+	}
+
+	r := Resolver{
+		Zones: zones,
+		Order: OrderNameHash,
+		Seed:  42,
+		Limit: 3,
+	}
+
+	results := make(map[string]struct{})
+	for i := 0; i < 10; i++ {
+		name := fmt.Sprintf("host%d.example.org", i)
+		first, err := r.LookupHost(context.Background(), name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(first) != 3 {
+			t.Errorf("%s: wrong amount of addresses: %v", name, first)
+		}
+		again, err := r.LookupHost(context.Background(), name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(first, again) {
+			t.Errorf("%s: order is not stable: %v, %v", name, first, again)
+		}
+		results[fmt.Sprint(first)] = struct{}{}
+	}
+	if len(results) < 2 {
+		t.Errorf("Same order is used for all names")
+	}
+
+	if addrs[0] != "10.0.0.0" || addrs[9] != "10.0.0.9" {
+		t.Errorf("Zone records are modified: %v", addrs)
+	}
+
+	// Different seed changes the order.
+	first, _ := r.LookupHost(context.Background(), "host0.example.org")
+	changed := false
+	for seed := int64(0); seed < 10 && !changed; seed++ {
+		r.Seed = seed
+		other, _ := r.LookupHost(context.Background(), "host0.example.org")
+		changed = !reflect.DeepEqual(first, other)
+	}
+	if !changed {
+		t.Errorf("Seed does not affect the order")
+	}
+}
+
+func TestResolver_OrderRoundRobin_PTR(t *testing.T) {
+	ptr := []string{"a.example.org.", "b.example.org.", "c.example.org."}
+	r := Resolver{
+		Zones: map[string]Zone{
+			"4.3.2.1.in-addr.arpa.": {PTR: ptr},
+		},
+		Order: OrderRoundRobin,
+	}
+
+	want := [][]string{
+		{"a.example.org.", "b.example.org.", "c.example.org."},
+		{"b.example.org.", "c.example.org.", "a.example.org."},
+		{"c.example.org.", "a.example.org.", "b.example.org."},
+		{"a.example.org.", "b.example.org.", "c.example.org."},
+	}
+	for i, w := range want {
+		names, err := r.LookupAddr(context.Background(), "1.2.3.4")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(names, w) {
+			t.Errorf("%d: want %v, got %v", i, w, names)
+		}
+	}
+
+	if !reflect.DeepEqual(ptr, want[0]) {
+		t.Errorf("Zone records are modified: %v", ptr)
+	}
+}
+
+func TestServer_OrderRoundRobin_PTR(t *testing.T) {
+	srv := NewUnstartedServer(map[string]Zone{
+		"4.3.2.1.in-addr.arpa.": {
+			PTR: []string{"a.example.org.", "b.example.org.", "c.example.org."},
+		},
+	})
+	srv.Resolver().Order = OrderRoundRobin
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	var r net.Resolver
+	srv.PatchNet(&r)
+
+	first := []string{}
+	for i := 0; i < 3; i++ {
+		names, err := r.LookupAddr(context.Background(), "1.2.3.4")
+		if err != nil {
+			t.Fatal(err)
+		}
+		first = append(first, names[0])
+	}
+	want := []string{"a.example.org.", "b.example.org.", "c.example.org."}
+	if !reflect.DeepEqual(first, want) {
+		t.Errorf("Wrong rotation, want %v, got %v", want, first)
+	}
+}
+
+func TestResolver_OrderShuffle_Seeded(t *testing.T) {
+	r := Resolver{
+		Zones: map[string]Zone{
+			"example.org.": {
+				A: []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5"},
+			},
+		},
+		Order: OrderShuffle,
+		Rand:  rand.New(rand.NewSource(42)),
+	}
+
+	var got [][]string
+	for i := 0; i < 3; i++ {
+		addrs, err := r.LookupHost(context.Background(), "example.org")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, addrs)
+	}
+
+	want := [][]string{
+		{"10.0.0.3", "10.0.0.4", "10.0.0.5", "10.0.0.1", "10.0.0.2"},
+		{"10.0.0.4", "10.0.0.5", "10.0.0.3", "10.0.0.2", "10.0.0.1"},
+		{"10.0.0.5", "10.0.0.1", "10.0.0.4", "10.0.0.3", "10.0.0.2"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Wrong order\nwant %q\n got %q", want, got)
+	}
+
+	// Same as Rand.Shuffle applied to the stored order on each lookup.
+	rng := rand.New(rand.NewSource(42))
+	for i := range want {
+		addrs := append([]string(nil), r.Zones["example.org."].A...)
+		rng.Shuffle(len(addrs), func(i, j int) {
+			addrs[i], addrs[j] = addrs[j], addrs[i]
+		})
+		if !reflect.DeepEqual(addrs, want[i]) {
+			t.Errorf("Lookup %d: order differs from Rand.Shuffle: %q", i, addrs)
+		}
+	}
+}
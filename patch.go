@@ -0,0 +1,55 @@
+//+build go1.14
+
+package mockdns
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+)
+
+// patchedResolver is the original configuration of the net.Resolver patched
+// using Server.Patch.
+type patchedResolver struct {
+	preferGo bool
+	dial     func(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+var (
+	patchedMu sync.Mutex
+	patched   = make(map[*net.Resolver]patchedResolver)
+)
+
+// Patch configures r to use this Server, like PatchNet, and restores its
+// original configuration when the test finishes. Any net.Resolver can be
+// patched, not only net.DefaultResolver, so code using multiple resolvers
+// can be tested with a different Server for each.
+//
+// Patched resolvers are tracked per process, so tests running in parallel
+// can patch different resolvers independently. Patching a resolver that is
+// already patched by another test fails the test. r must not be used
+// concurrently while it is patched or restored.
+func (s *Server) Patch(tb testing.TB, r *net.Resolver) {
+	tb.Helper()
+
+	patchedMu.Lock()
+	defer patchedMu.Unlock()
+
+	if _, ok := patched[r]; ok {
+		tb.Fatalf("mockdns: net.Resolver %p is already patched", r)
+		return
+	}
+	patched[r] = patchedResolver{preferGo: r.PreferGo, dial: r.Dial}
+	s.PatchNet(r)
+
+	tb.Cleanup(func() {
+		patchedMu.Lock()
+		defer patchedMu.Unlock()
+
+		orig := patched[r]
+		r.PreferGo = orig.preferGo
+		r.Dial = orig.dial
+		delete(patched, r)
+	})
+}
@@ -0,0 +1,75 @@
+//+build go1.14
+
+package mockdns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestServer_Patch(t *testing.T) {
+	newServer := func(addr string) *Server {
+		srv, err := NewServer(map[string]Zone{
+			"example.org.": {
+				A: []string{addr},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { srv.Close() })
+		return srv
+	}
+	srv1, srv2 := newServer("192.0.2.1"), newServer("192.0.2.2")
+
+	errOrig := errors.New("original dialer")
+	origDial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		return nil, errOrig
+	}
+	r1 := &net.Resolver{Dial: origDial}
+	r2 := &net.Resolver{}
+
+	t.Run("patched", func(t *testing.T) {
+		srv1.Patch(t, r1)
+		srv2.Patch(t, r2)
+
+		for _, c := range []struct {
+			r    *net.Resolver
+			want string
+		}{
+			{r1, "192.0.2.1"},
+			{r2, "192.0.2.2"},
+		} {
+			addrs, err := c.r.LookupHost(context.Background(), "example.org")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(addrs) != 1 || addrs[0] != c.want {
+				t.Errorf("Want %s, got %v", c.want, addrs)
+			}
+		}
+
+		var ftb fakeTB
+		srv2.Patch(&ftb, r1)
+		if len(ftb.failures) != 1 {
+			t.Errorf("Expected one failure, got %v", ftb.failures)
+		}
+	})
+
+	if r1.PreferGo || r1.Dial == nil {
+		t.Fatal("Resolver is not restored")
+	}
+	if _, err := r1.Dial(context.Background(), "udp", ""); err != errOrig {
+		t.Error("Original dialer is not restored")
+	}
+	if r2.PreferGo || r2.Dial != nil {
+		t.Error("Resolver is not restored")
+	}
+
+	// Resolvers can be patched again after restoration.
+	t.Run("repatched", func(t *testing.T) {
+		srv2.Patch(t, r1)
+	})
+}
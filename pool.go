@@ -0,0 +1,72 @@
+package mockdns
+
+import (
+	"net"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// CIDRPool allocates addresses from a network sequentially, wrapping around
+// after the last one. It can be used as Zone.Generate to return the next
+// address on each lookup, e.g. to simulate a pool of load balancer VIPs:
+//
+//	pool, err := mockdns.NewCIDRPool("192.0.2.0/30")
+//	...
+//	zones["vip.example.org."] = mockdns.Zone{Generate: pool.Generate}
+//
+// CIDRPool is safe for concurrent use.
+type CIDRPool struct {
+	network *net.IPNet
+
+	mu   sync.Mutex
+	next net.IP
+}
+
+// NewCIDRPool returns the pool for the network in CIDR notation. All
+// addresses of the network are allocated, including the first and the
+// last one.
+func NewCIDRPool(cidr string) (*CIDRPool, error) {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	return &CIDRPool{
+		network: network,
+		next:    append(net.IP(nil), network.IP...),
+	}, nil
+}
+
+// Next returns the next address from the pool.
+func (p *CIDRPool) Next() net.IP {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ip := append(net.IP(nil), p.next...)
+	for i := len(p.next) - 1; i >= 0; i-- {
+		p.next[i]++
+		if p.next[i] != 0 {
+			break
+		}
+	}
+	if !p.network.Contains(p.next) {
+		copy(p.next, p.network.IP)
+	}
+	return ip
+}
+
+// Generate returns the zone with the next address from the pool as the A
+// record (AAAA for IPv6 networks). Queries of other types get an empty
+// zone and do not allocate an address.
+func (p *CIDRPool) Generate(q dns.Question) Zone {
+	if p.network.IP.To4() != nil {
+		if q.Qtype != dns.TypeA {
+			return Zone{}
+		}
+		return Zone{A: []string{p.Next().String()}}
+	}
+	if q.Qtype != dns.TypeAAAA {
+		return Zone{}
+	}
+	return Zone{AAAA: []string{p.Next().String()}}
+}
@@ -0,0 +1,46 @@
+package mockdns
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestCIDRPool(t *testing.T) {
+	pool, err := NewCIDRPool("192.0.2.0/30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := Resolver{Zones: map[string]Zone{
+		"vip.example.org.": {Generate: pool.Generate},
+	}}
+
+	var got []string
+	for i := 0; i < 6; i++ {
+		addrs, err := r.LookupHost(context.Background(), "vip.example.org")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, addrs...)
+	}
+	want := []string{
+		"192.0.2.0", "192.0.2.1", "192.0.2.2", "192.0.2.3",
+		"192.0.2.0", "192.0.2.1",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Wrong addresses\nwant %v\n got %v", want, got)
+	}
+
+	pool6, err := NewCIDRPool("2001:db8::fe/127")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = nil
+	for i := 0; i < 3; i++ {
+		got = append(got, pool6.Next().String())
+	}
+	want = []string{"2001:db8::fe", "2001:db8::ff", "2001:db8::fe"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Wrong addresses\nwant %v\n got %v", want, got)
+	}
+}
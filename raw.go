@@ -0,0 +1,51 @@
+package mockdns
+
+import (
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// rawReader intercepts UDP queries before they are parsed to answer them
+// using Server.RawBytes.
+type rawReader struct {
+	dns.PacketConnReader
+	s *Server
+}
+
+func (s *Server) decorateReader(r dns.Reader) dns.Reader {
+	return rawReader{PacketConnReader: r.(dns.PacketConnReader), s: s}
+}
+
+func (r rawReader) ReadUDP(conn *net.UDPConn, timeout time.Duration) ([]byte, *dns.SessionUDP, error) {
+	for {
+		m, sess, err := r.PacketConnReader.ReadUDP(conn, timeout)
+		if err != nil || r.s.RawBytes == nil {
+			return m, sess, err
+		}
+		resp := r.s.RawBytes(m)
+		if resp == nil {
+			return m, sess, err
+		}
+		if _, err := dns.WriteToSessionUDP(conn, resp, sess); err != nil {
+			r.s.Log.Printf("raw response write failed: %v", err)
+		}
+	}
+}
+
+func (r rawReader) ReadPacketConn(conn net.PacketConn, timeout time.Duration) ([]byte, net.Addr, error) {
+	for {
+		m, addr, err := r.PacketConnReader.ReadPacketConn(conn, timeout)
+		if err != nil || r.s.RawBytes == nil {
+			return m, addr, err
+		}
+		resp := r.s.RawBytes(m)
+		if resp == nil {
+			return m, addr, err
+		}
+		if _, err := conn.WriteTo(resp, addr); err != nil {
+			r.s.Log.Printf("raw response write failed: %v", err)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package mockdns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// RecordingResolver wraps a real net.Resolver and stores results of all
+// successful lookups so they can be used later as fixtures with Resolver
+// or Server (see ExportZones).
+type RecordingResolver struct {
+	real *net.Resolver
+
+	mu    sync.Mutex
+	zones map[string]Zone
+}
+
+// Record returns RecordingResolver that uses real for lookups.
+func Record(real *net.Resolver) *RecordingResolver {
+	return &RecordingResolver{
+		real:  real,
+		zones: make(map[string]Zone),
+	}
+}
+
+func (rr *RecordingResolver) update(name string, f func(z *Zone)) {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+
+	name = strings.ToLower(dns.Fqdn(name))
+	z := rr.zones[name]
+	f(&z)
+	rr.zones[name] = z
+}
+
+// ExportZones returns the recorded lookup results as zones map usable with
+// Resolver and Server.
+func (rr *RecordingResolver) ExportZones() map[string]Zone {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+
+	zones := make(map[string]Zone, len(rr.zones))
+	for name, z := range rr.zones {
+		zones[name] = z
+	}
+	return zones
+}
+
+func (rr *RecordingResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	names, err := rr.real.LookupAddr(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	arpa, err := dns.ReverseAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	rr.update(arpa, func(z *Zone) {
+		z.PTR = append([]string(nil), names...)
+	})
+	return names, nil
+}
+
+func (rr *RecordingResolver) LookupCNAME(ctx context.Context, host string) (string, error) {
+	cname, err := rr.real.LookupCNAME(ctx, host)
+	if err != nil {
+		return "", err
+	}
+
+	// net.Resolver returns the host itself if there is no CNAME.
+	if !strings.EqualFold(dns.Fqdn(cname), dns.Fqdn(host)) {
+		rr.update(host, func(z *Zone) {
+			z.CNAME = cname
+		})
+	}
+	return cname, nil
+}
+
+func (rr *RecordingResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	addrs, err := rr.real.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	rr.update(host, func(z *Zone) {
+		z.A, z.AAAA = nil, nil
+		for _, addr := range addrs {
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				continue
+			}
+			if ip.To4() != nil {
+				z.A = append(z.A, addr)
+			} else {
+				z.AAAA = append(z.AAAA, addr)
+			}
+		}
+	})
+	return addrs, nil
+}
+
+func (rr *RecordingResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	addrs, err := rr.real.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	rr.update(host, func(z *Zone) {
+		z.A, z.AAAA = nil, nil
+		for _, addr := range addrs {
+			if addr.IP.To4() != nil {
+				z.A = append(z.A, addr.IP.String())
+			} else {
+				z.AAAA = append(z.AAAA, addr.IP.String())
+			}
+		}
+	})
+	return addrs, nil
+}
+
+func (rr *RecordingResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	mxs, err := rr.real.LookupMX(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	rr.update(name, func(z *Zone) {
+		z.MX = nil
+		for _, mx := range mxs {
+			z.MX = append(z.MX, *mx)
+		}
+	})
+	return mxs, nil
+}
+
+func (rr *RecordingResolver) LookupNS(ctx context.Context, name string) ([]*net.NS, error) {
+	nss, err := rr.real.LookupNS(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	rr.update(name, func(z *Zone) {
+		z.NS = nil
+		for _, ns := range nss {
+			z.NS = append(z.NS, *ns)
+		}
+	})
+	return nss, nil
+}
+
+func (rr *RecordingResolver) LookupPort(ctx context.Context, network, service string) (int, error) {
+	return rr.real.LookupPort(ctx, network, service)
+}
+
+func (rr *RecordingResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	cname, srvs, err := rr.real.LookupSRV(ctx, service, proto, name)
+	if err != nil {
+		return "", nil, err
+	}
+
+	query := name
+	if service != "" || proto != "" {
+		query = fmt.Sprintf("_%s._%s.%s", service, proto, name)
+	}
+	rr.update(query, func(z *Zone) {
+		z.SRV = nil
+		for _, srv := range srvs {
+			z.SRV = append(z.SRV, *srv)
+		}
+	})
+	return cname, srvs, nil
+}
+
+func (rr *RecordingResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	txts, err := rr.real.LookupTXT(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	rr.update(name, func(z *Zone) {
+		z.TXT = append([]string(nil), txts...)
+	})
+	return txts, nil
+}
+
+var _ netResolver = (*RecordingResolver)(nil)
@@ -0,0 +1,73 @@
+package mockdns
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestRecord(t *testing.T) {
+	zones := map[string]Zone{
+		"example.org.": {
+			A:    []string{"1.2.3.4"},
+			AAAA: []string{"2001:db8::1"},
+			MX:   []net.MX{{Host: "mx.example.org.", Pref: 10}},
+			NS:   []net.NS{{Host: "ns.example.org."}},
+			TXT:  []string{"v=spf1 -all"},
+		},
+		"_imap._tcp.example.org.": {
+			SRV: []net.SRV{{Target: "mx.example.org.", Port: 143, Priority: 1, Weight: 1}},
+		},
+		"4.3.2.1.in-addr.arpa.": {
+			PTR: []string{"example.org."},
+		},
+	}
+	srv, err := NewServer(zones)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	var real net.Resolver
+	srv.PatchNet(&real)
+
+	rec := Record(&real)
+	ctx := context.Background()
+	if _, err := rec.LookupHost(ctx, "example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rec.LookupMX(ctx, "example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rec.LookupNS(ctx, "example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rec.LookupTXT(ctx, "example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := rec.LookupSRV(ctx, "imap", "tcp", "example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rec.LookupAddr(ctx, "1.2.3.4"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rec.LookupHost(ctx, "missing.example.org"); err == nil {
+		t.Fatal("Expected error, got nil")
+	}
+
+	exported := rec.ExportZones()
+	if !reflect.DeepEqual(exported, zones) {
+		t.Errorf("Wrong exported zones\nwant %+v\n got %+v", zones, exported)
+	}
+
+	// Exported zones can be used to replay the lookups.
+	replay := Resolver{Zones: exported}
+	mxs, err := replay.LookupMX(ctx, "example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mxs) != 1 || mxs[0].Host != "mx.example.org." {
+		t.Errorf("Wrong replayed MX: %v", mxs)
+	}
+}
@@ -3,8 +3,14 @@ package mockdns
 import (
 	"context"
 	"fmt"
+	"hash/fnv"
+	"math/rand"
 	"net"
+	"reflect"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/miekg/dns"
 )
@@ -14,6 +20,11 @@ type Zone struct {
 	// For Server, non-nil value results in SERVFAIL response.
 	Err error
 
+	// TTL is the TTL of records in Server responses built from the fields
+	// of this zone. Records in Misc have their own TTL. 0 means the default
+	// TTL of 9999 seconds.
+	TTL uint32
+
 	// When used with Server, set the Authenticated Data (AD) flag
 	// in the responses.
 	AD bool
@@ -27,19 +38,266 @@ type Zone struct {
 	NS    []net.NS
 	SRV   []net.SRV
 
+	// OPENPGPKEY contains base64-encoded OpenPGP public keys (RFC 7929) and
+	// SMIMEA contains S/MIME certificate associations (RFC 8162). They can
+	// be returned only when used with Server. See OPENPGPKEYName and
+	// SMIMEAName for the owner names.
+	OPENPGPKEY []string
+	SMIMEA     []TLSA
+
 	// Misc includes other associated zone records, they can be returned only
-	// when used with Server.
+	// when used with Server. Records are sent as is, e.g. SVCB and HTTPS
+	// records keep the mandatory parameter and parameters with unknown keys
+	// (dns.SVCBLocal).
+	//
+	// If there is no SOA record in Misc, Server synthesizes one.
+	//
+	// RRSIG, NSEC and NSEC3 records are returned only for queries of their
+	// type or if the query has the EDNS DO flag set (RFC 4035). In the
+	// latter case, RRSIG records are also added to answers for the records
+	// they cover.
 	Misc map[dns.Type][]dns.RR
+
+	// EDE is the Extended DNS Error (RFC 8914) that Server attaches to
+	// all responses for this zone if the query uses EDNS, regardless of the
+	// response code.
+	EDE *dns.EDNS0_EDE
+
+	// Delegated marks the zone as a delegation point. Server answers queries
+	// for this name and any name below it with a referral to the
+	// nameservers listed in NS instead of answer records.
+	// Resolver ignores this flag.
+	Delegated bool
+
+	// Recursive makes Server answer queries with the RD flag set for names
+	// at or below the Delegated zone from Zones, as a recursive resolver
+	// would, instead of returning the referral. Queries without the RD flag
+	// still get the referral.
+	Recursive bool
+
+	// NoGlue disables addition of the address records of nameservers (glue)
+	// to referrals for the delegation. This forces the client to resolve
+	// the nameserver names separately.
+	NoGlue bool
+
+	// Lame makes Server behave as a lame server for this name and any name
+	// below it: it answers without the AA and RA flags (AA is set in other
+	// answers from Zones) and with a referral instead of answer records. The
+	// referral lists NS of the zone or, if there are none, root servers
+	// (upward referral). Resolver ignores this flag.
+	Lame bool
+
+	// Sticky makes Server return only one of A and AAAA records, the same
+	// one for each client IP address. Resolver always returns the
+	// first one.
+	Sticky bool
+
+	// TypeErr specifies the error to return on lookups of the specified
+	// record type in this zone. It is checked after Err.
+	//
+	// Note that LookupHost (and net.Resolver for Server) ignores the error
+	// for one address family if the other one returned any addresses. E.g.
+	// an error for dns.TypeAAAA allows to simulate a broken IPv6
+	// resolver while A lookups still succeed.
+	TypeErr map[dns.Type]error
+
+	// FailAfter makes lookups of this zone fail with a temporary error
+	// (SERVFAIL for Server) after FailAfter successful ones, until
+	// Resolver.ResetCounters is called. Lookups of all record types are
+	// counted, e.g. LookupHost counts as two. 0 means no limit.
+	FailAfter int
+
+	// Delay specifies the delay before any lookup in this zone completes,
+	// including lookups failing due to Err, TypeErr or FailAfter. The
+	// delay is interrupted if the lookup context is cancelled.
+	Delay time.Duration
+
+	// TypeDelay specifies the delay before the lookup of the specified
+	// record type in this zone completes, overriding Delay.
+	TypeDelay map[dns.Type]time.Duration
+
+	// Generate, if set, is called for each lookup of this zone and the
+	// returned Zone is used instead of the static records above. This allows
+	// returning different records on each query (e.g. random addresses).
+	//
+	// Generate of the returned Zone is ignored.
+	Generate func(q dns.Question) Zone
+}
+
+// Normalize converts all target names in the zone (CNAME, PTR, MX.Host,
+// NS.Host, SRV.Target) into FQDNs, in place.
+func (z *Zone) Normalize() {
+	if z.CNAME != "" {
+		z.CNAME = dns.Fqdn(z.CNAME)
+	}
+	for i := range z.PTR {
+		z.PTR[i] = dns.Fqdn(z.PTR[i])
+	}
+	for i := range z.MX {
+		z.MX[i].Host = dns.Fqdn(z.MX[i].Host)
+	}
+	for i := range z.NS {
+		z.NS[i].Host = dns.Fqdn(z.NS[i].Host)
+	}
+	for i := range z.SRV {
+		z.SRV[i].Target = dns.Fqdn(z.SRV[i].Target)
+	}
 }
 
 // Resolver is the struct that implements interface same as net.Resolver
 // and so can be used as a drop-in replacement for it if tested code
 // supports it.
+//
+// If tested code defines its own interface for the resolver, add a
+// compile-time check to catch signature mismatches early:
+//
+//	var _ MyResolver = (*mockdns.Resolver)(nil)
 type Resolver struct {
+	// Zones maps domain names to their records. Lookup cost does not depend
+	// on the amount of zones. To detect empty non-terminals, Server indexes
+	// the names in Zones. The index is rebuilt when the amount of zones
+	// changes or AddZone or RemoveZone is used, so use them if you replace
+	// names while the resolver is in use.
+	//
+	// Names with the leftmost "*" label are wildcards and are used for
+	// lookups of names below them that are not present in Zones (RFC 4592).
+	// Lookups of the "*" name itself return its records as is.
 	Zones map[string]Zone
 
 	// Don't follow CNAME in Zones for Lookup*.
 	SkipCNAME bool
+
+	// Default, if set, is used for names that are not present in Zones.
+	Default *Zone
+
+	// Fallback, if set, is used for lookups that would otherwise fail with
+	// the "not found" error, allowing to override only some names.
+	//
+	// Note that this makes real network requests for all names not in
+	// Zones (unless Default is set).
+	Fallback *net.Resolver
+
+	// Order specifies the order of A, AAAA and PTR records in lookup
+	// results. By default, records are returned in the order they are
+	// listed in Zone.
+	Order Order
+
+	// Seed is used for OrderNameHash.
+	Seed int64
+
+	// Rand is used for OrderShuffle. If nil, the global math/rand source is
+	// used.
+	Rand *rand.Rand
+
+	// Limit specifies the maximum amount of A, AAAA and PTR records
+	// returned for each lookup, after Order is applied. 0 means no limit.
+	Limit int
+
+	// DNS64Prefix, if set, enables DNS64 (RFC 6147): AAAA records are
+	// synthesized from A records for zones without AAAA records by embedding
+	// IPv4 addresses into the prefix as specified in RFC 6052. Prefix length
+	// must be 32, 40, 48, 56, 64 or 96, e.g. 64:ff9b::/96.
+	//
+	// It is also used by Server.
+	DNS64Prefix *net.IPNet
+
+	// Timeout specifies the internal timeout of the resolver for each
+	// lookup. If the zone delay exceeds it, the lookup fails with the
+	// timeout error after Timeout passes, unless the lookup context is
+	// done earlier. 0 means no timeout.
+	Timeout time.Duration
+
+	// PortErr, if set, is returned by LookupPort instead of looking up the
+	// port using the system services database.
+	PortErr error
+
+	// WarmUp makes Zone.Delay and Zone.TypeDelay apply only until the
+	// first lookup of each name completes, like with a caching resolver
+	// that is slow only on cache misses. Names stay warm until
+	// ResetCounters is called.
+	WarmUp bool
+
+	// Now is used to get the current time. If nil, time.Now is used.
+	// Set it to simulate time passing without real sleeps. Use SetNow to
+	// change it while the resolver is in use.
+	Now func() time.Time
+
+	mu       sync.Mutex
+	changes  map[string][]scheduledChange
+	rotation map[queryKey]int
+	lookups  map[string]int
+	warm     map[string]struct{}
+	queries  map[queryKey]int
+	expected map[queryKey]struct{}
+
+	ancestorIdx map[uintptr]ancestorIndex
+}
+
+type scheduledChange struct {
+	at   time.Time
+	zone Zone
+}
+
+// SetNow sets Now. Unlike assigning the field, it is safe to use while
+// the resolver is in use, e.g. by a running Server.
+func (r *Resolver) SetNow(now func() time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Now = now
+}
+
+func (r *Resolver) now() time.Time {
+	r.mu.Lock()
+	now := r.Now
+	r.mu.Unlock()
+	if now != nil {
+		return now()
+	}
+	return time.Now()
+}
+
+// ScheduleChange replaces the zone for name with newZone once the current
+// time (see Resolver.Now) is at or after at. Zones map itself is not
+// modified. If multiple changes are due, the latest one is used.
+func (r *Resolver) ScheduleChange(name string, at time.Time, newZone Zone) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.changes == nil {
+		r.changes = make(map[string][]scheduledChange)
+	}
+
+	name = strings.ToLower(dns.Fqdn(name))
+	// Build a new slice, scheduledZone may be reading the old one.
+	old := r.changes[name]
+	changes := make([]scheduledChange, 0, len(old)+1)
+	changes = append(changes, old...)
+	changes = append(changes, scheduledChange{at: at, zone: newZone})
+	sort.SliceStable(changes, func(i, j int) bool {
+		return changes[i].at.Before(changes[j].at)
+	})
+	r.changes[name] = changes
+}
+
+// scheduledZone returns the zone from the latest due scheduled change
+// for the name.
+func (r *Resolver) scheduledZone(name string) (Zone, bool) {
+	r.mu.Lock()
+	// ScheduleChange replaces the slice instead of modifying it, so it can
+	// be used after unlocking.
+	changes := r.changes[name]
+	r.mu.Unlock()
+	if len(changes) == 0 {
+		return Zone{}, false
+	}
+
+	now := r.now()
+	for i := len(changes) - 1; i >= 0; i-- {
+		if !changes[i].at.After(now) {
+			return changes[i].zone, true
+		}
+	}
+	return Zone{}, false
 }
 
 func (r *Resolver) LookupAddr(ctx context.Context, addr string) (names []string, err error) {
@@ -48,91 +306,610 @@ func (r *Resolver) LookupAddr(ctx context.Context, addr string) (names []string,
 		return nil, err
 	}
 
-	rzone, ok := r.Zones[strings.ToLower(arpa)]
+	r.record(dns.TypePTR, arpa)
+
+	rzone, ok := r.zone(ctx, arpa, dns.TypePTR)
 	if !ok {
+		if r.Fallback != nil {
+			return r.Fallback.LookupAddr(ctx, addr)
+		}
 		return nil, notFound(arpa)
 	}
-	if rzone.Err != nil {
-		return nil, rzone.Err
+	if err := r.wait(ctx, arpa, rzone, dns.TypePTR); err != nil {
+		return nil, err
+	}
+	if err := r.zoneErr(arpa, rzone, dns.TypePTR); err != nil {
+		return nil, err
 	}
 
-	names = make([]string, len(rzone.PTR))
-	copy(names, rzone.PTR)
-	return
+	return r.order(dns.TypePTR, arpa, rzone.PTR), nil
 }
 
 func (r *Resolver) LookupCNAME(ctx context.Context, host string) (cname string, err error) {
-	rzone, ok := r.Zones[strings.ToLower(host)]
+	r.record(dns.TypeCNAME, host)
+
+	rzone, ok := r.zone(ctx, host, dns.TypeCNAME)
 	if !ok {
+		if r.Fallback != nil {
+			return r.Fallback.LookupCNAME(ctx, host)
+		}
 		return "", notFound(host)
 	}
+	if err := r.wait(ctx, host, rzone, dns.TypeCNAME); err != nil {
+		return "", err
+	}
+	if err := r.zoneErr(host, rzone, dns.TypeCNAME); err != nil {
+		return "", err
+	}
 
 	return rzone.CNAME, nil
 }
 
 func (r *Resolver) LookupHost(ctx context.Context, host string) (addrs []string, err error) {
-	_, addrs4, err := r.lookupA(ctx, host)
-	if err != nil {
-		return nil, err
-	}
-	_, addrs6, err := r.lookupAAAA(ctx, host)
+	addrs4, addrs6, err := r.lookupIP(ctx, host)
 	if err != nil {
 		return nil, err
 	}
 
 	addrs = append(addrs, addrs4...)
 	addrs = append(addrs, addrs6...)
+	return addrs, nil
+}
+
+// lookupIP does both A and AAAA lookups. Error is returned only if there are
+// no addresses of either family.
+func (r *Resolver) lookupIP(ctx context.Context, host string) (addrs4, addrs6 []string, err error) {
+	_, addrs4, err4 := r.lookupA(ctx, host)
+	_, addrs6, err6 := r.lookupAAAA(ctx, host)
+
+	if len(addrs4) == 0 && len(addrs6) == 0 {
+		if r.useFallback(err4) && r.useFallback(err6) {
+			addrs, err := r.Fallback.LookupHost(ctx, host)
+			if err != nil {
+				return nil, nil, err
+			}
+			for _, addr := range addrs {
+				if strings.Contains(addr, ":") {
+					addrs6 = append(addrs6, addr)
+				} else {
+					addrs4 = append(addrs4, addr)
+				}
+			}
+			return addrs4, addrs6, nil
+		}
+		if err4 != nil {
+			return nil, nil, err4
+		}
+		if err6 != nil {
+			return nil, nil, err6
+		}
+		return nil, nil, notFound(host)
+	}
+
+	return addrs4, addrs6, nil
+}
 
-	if len(addrs) == 0 {
-		return nil, notFound(host)
+// useFallback reports whether the lookup that failed with err should be
+// retried using Fallback.
+func (r *Resolver) useFallback(err error) bool {
+	if r.Fallback == nil {
+		return false
 	}
+	dnsErr, ok := err.(*net.DNSError)
+	return ok && isNotFound(dnsErr)
+}
+
+// err returns the error that should be returned for lookups of qtype in this
+// zone.
+func (z Zone) err(qtype uint16) error {
+	if z.Err != nil {
+		return z.Err
+	}
+	return z.TypeErr[dns.Type(qtype)]
+}
+
+// zoneErr returns the error that should be returned for the lookup of qtype
+// for name in zone, counting the lookup for Zone.FailAfter.
+func (r *Resolver) zoneErr(name string, zone Zone, qtype uint16) error {
+	if err := zone.err(qtype); err != nil {
+		return err
+	}
+	if zone.FailAfter <= 0 {
+		return nil
+	}
+
+	r.mu.Lock()
+	if r.lookups == nil {
+		r.lookups = make(map[string]int)
+	}
+	key := strings.ToLower(dns.Fqdn(name))
+	r.lookups[key]++
+	n := r.lookups[key]
+	r.mu.Unlock()
+
+	if n > zone.FailAfter {
+		return &net.DNSError{
+			Err:         "server misbehaving",
+			Name:        name,
+			Server:      "127.0.0.1:53",
+			IsTemporary: true,
+		}
+	}
+	return nil
+}
+
+// ResetCounters resets the per-name lookup counters used for
+// Zone.FailAfter and OrderRoundRobin and the names warmed up with WarmUp.
+func (r *Resolver) ResetCounters() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.lookups = nil
+	r.rotation = nil
+	r.warm = nil
+}
+
+// viewZonesKey is the context key for the zones of the Server view used for
+// the query.
+type viewZonesKey struct{}
+
+// zones returns the zones to use for lookups: zones of the Server view if
+// ctx has them, Zones otherwise.
+func (r *Resolver) zones(ctx context.Context) map[string]Zone {
+	if zones, ok := ctx.Value(viewZonesKey{}).(map[string]Zone); ok {
+		return zones
+	}
+	return r.Zones
+}
+
+// zone returns the zone for the specified name, calling Zone.Generate if it is
+// set.
+func (r *Resolver) zone(ctx context.Context, name string, qtype uint16) (Zone, bool) {
+	name = strings.ToLower(dns.Fqdn(name))
+	zones := r.zones(ctx)
+	rzone, ok := zones[name]
+	if changed, due := r.scheduledZone(name); due {
+		rzone, ok = changed, true
+	}
+	if !ok {
+		rzone, ok = wildcard(zones, r.ancestors(zones), name)
+	}
+	if !ok {
+		if r.Default == nil {
+			return Zone{}, false
+		}
+		rzone = *r.Default
+	}
+
+	return rzone.generate(name, qtype), true
+}
+
+// wildcard returns the wildcard zone in zones matching name (RFC 4592), if
+// any. name must be normalized, ancestors is the set of ancestors of names in
+// zones. Only the wildcard at the closest existing ancestor of name is used,
+// including empty non-terminals, e.g. "*.example.org." does not match
+// "a.b.example.org." if "b.example.org." or "c.b.example.org." is present.
+func wildcard(zones map[string]Zone, ancestors map[string]struct{}, name string) (Zone, bool) {
+	if _, ok := ancestors[name]; ok {
+		// The name itself is an empty non-terminal.
+		return Zone{}, false
+	}
+	for _, i := range dns.Split(name) {
+		if i == 0 {
+			// The name itself is not present.
+			continue
+		}
+		parent := name[i:]
+		if z, ok := zones["*."+parent]; ok {
+			return z, true
+		}
+		if _, ok := zones[parent]; ok {
+			return Zone{}, false
+		}
+		if _, ok := ancestors[parent]; ok {
+			return Zone{}, false
+		}
+	}
+	if z, ok := zones["*."]; ok && name != "." {
+		return z, true
+	}
+	return Zone{}, false
+}
+
+// generate returns the result of Zone.Generate for the question if it is set,
+// or the zone itself otherwise.
+func (z Zone) generate(name string, qtype uint16) Zone {
+	if z.Generate == nil {
+		return z
+	}
+	gen := z.Generate(dns.Question{
+		Name:   name,
+		Qtype:  qtype,
+		Qclass: dns.ClassINET,
+	})
+	gen.Generate = nil
+	return gen
+}
 
-	return addrs, err
+// isEmptyNonTerminal reports whether name has no zone configured but is an
+// ancestor of some configured name (e.g. "b.example.org." if only
+// "a.b.example.org." is present).
+func (r *Resolver) isEmptyNonTerminal(ctx context.Context, name string) bool {
+	name = strings.ToLower(dns.Fqdn(name))
+	zones := r.zones(ctx)
+	if _, ok := zones[name]; ok {
+		return false
+	}
+	_, ok := r.ancestors(zones)[name]
+	return ok
+}
+
+// ancestorIndex is the set of all ancestors of names in zones.
+type ancestorIndex struct {
+	// zones is kept to prevent reuse of its address for another map.
+	zones map[string]Zone
+	n     int
+	names map[string]struct{}
 }
 
-func (r *Resolver) targetZone(name string) (cname string, zone Zone, err error) {
-	rzone, ok := r.Zones[strings.ToLower(dns.Fqdn(name))]
+// ancestors returns the set of all ancestors of names in zones. It is
+// rebuilt only if the amount of zones changed or AddZone or RemoveZone were
+// used since it was built.
+func (r *Resolver) ancestors(zones map[string]Zone) map[string]struct{} {
+	ptr := reflect.ValueOf(zones).Pointer()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if idx, ok := r.ancestorIdx[ptr]; ok && idx.n == len(zones) {
+		return idx.names
+	}
+
+	names := make(map[string]struct{})
+	for key := range zones {
+		for _, i := range dns.Split(key) {
+			if i != 0 {
+				names[key[i:]] = struct{}{}
+			}
+		}
+		if key != "." {
+			names["."] = struct{}{}
+		}
+	}
+	// Views and TCPZones are indexed separately, drop indexes of maps that
+	// are no longer used once in a while.
+	if r.ancestorIdx == nil || len(r.ancestorIdx) >= 16 {
+		r.ancestorIdx = make(map[uintptr]ancestorIndex)
+	}
+	r.ancestorIdx[ptr] = ancestorIndex{zones: zones, n: len(zones), names: names}
+	return names
+}
+
+// wait blocks for the zone delay configured for qtype, returning an error if
+// ctx is done or Timeout passes first.
+func (r *Resolver) wait(ctx context.Context, name string, zone Zone, qtype uint16) error {
+	d, ok := zone.TypeDelay[dns.Type(qtype)]
 	if !ok {
-		return "", Zone{}, notFound(name)
+		d = zone.Delay
+	}
+	if d <= 0 {
+		return nil
 	}
 
-	if rzone.Err != nil {
-		return "", rzone, rzone.Err
+	var key string
+	if r.WarmUp {
+		key = strings.ToLower(dns.Fqdn(name))
+		r.mu.Lock()
+		_, warm := r.warm[key]
+		r.mu.Unlock()
+		if warm {
+			return nil
+		}
 	}
 
-	cname = rzone.CNAME
+	timedOut := false
+	if r.Timeout > 0 && d > r.Timeout {
+		d, timedOut = r.Timeout, true
+	}
 
-	if !r.SkipCNAME {
-		for rzone.CNAME != "" {
-			rzone, ok = r.Zones[strings.ToLower(rzone.CNAME)]
-			if !ok {
-				return cname, Zone{}, notFound(rzone.CNAME)
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		if timedOut {
+			return &net.DNSError{
+				Err:       "i/o timeout",
+				Name:      name,
+				Server:    "127.0.0.1:53",
+				IsTimeout: true,
 			}
-			if rzone.Err != nil {
-				return "", rzone, rzone.Err
+		}
+		if r.WarmUp {
+			r.mu.Lock()
+			if r.warm == nil {
+				r.warm = make(map[string]struct{})
 			}
+			r.warm[key] = struct{}{}
+			r.mu.Unlock()
+		}
+		return nil
+	case <-ctx.Done():
+		return &net.DNSError{
+			Err:       ctx.Err().Error(),
+			Name:      name,
+			Server:    "127.0.0.1:53",
+			IsTimeout: ctx.Err() == context.DeadlineExceeded,
 		}
 	}
+}
 
-	return cname, rzone, nil
+func (r *Resolver) targetZone(ctx context.Context, name string, qtype uint16) (cname string, zone Zone, err error) {
+	chain, zone, err := r.followCNAME(ctx, name, qtype)
+	if len(chain) != 0 {
+		cname = chain[0]
+	}
+	return cname, zone, err
+}
+
+// errCNAMELoop is the text of the error returned for CNAME loops.
+const errCNAMELoop = "CNAME loop"
+
+// followCNAME returns the zone for name, following CNAMEs unless SkipCNAME is
+// set. chain contains the CNAME targets that were followed, in order.
+func (r *Resolver) followCNAME(ctx context.Context, name string, qtype uint16) (chain []string, zone Zone, err error) {
+	// Normalize once, record and zone do not allocate for normalized names.
+	key := strings.ToLower(dns.Fqdn(name))
+	r.record(qtype, key)
+
+	rzone, ok := r.zone(ctx, key, qtype)
+	if !ok {
+		return nil, Zone{}, notFound(name)
+	}
+
+	if err := r.wait(ctx, name, rzone, qtype); err != nil {
+		return nil, Zone{}, err
+	}
+
+	if err := r.zoneErr(name, rzone, qtype); err != nil {
+		return nil, rzone, err
+	}
+
+	if r.SkipCNAME {
+		if rzone.CNAME != "" {
+			chain = []string{rzone.CNAME}
+		}
+		return chain, rzone, nil
+	}
+
+	if rzone.CNAME == "" {
+		return nil, rzone, nil
+	}
+
+	seen := map[string]struct{}{
+		key: {},
+	}
+	for rzone.CNAME != "" {
+		target := rzone.CNAME
+		chain = append(chain, target)
+
+		key = strings.ToLower(dns.Fqdn(target))
+		if _, ok := seen[key]; ok {
+			return chain, Zone{}, &net.DNSError{
+				Err:    errCNAMELoop,
+				Name:   name,
+				Server: "127.0.0.1:53",
+			}
+		}
+		seen[key] = struct{}{}
+
+		rzone, ok = r.zone(ctx, key, qtype)
+		if !ok {
+			return chain, Zone{}, notFound(target)
+		}
+		if err := r.zoneErr(target, rzone, qtype); err != nil {
+			return nil, rzone, err
+		}
+	}
+
+	return chain, rzone, nil
+}
+
+// AddZone normalizes the zone (see Zone.Normalize) and adds it to Zones
+// under the normalized name, replacing any existing zone.
+func (r *Resolver) AddZone(name string, z Zone) {
+	z.Normalize()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.Zones == nil {
+		r.Zones = make(map[string]Zone)
+	}
+	r.Zones[strings.ToLower(dns.Fqdn(name))] = z
+	r.ancestorIdx = nil
+}
+
+// RemoveZone removes the zone for name from Zones.
+func (r *Resolver) RemoveZone(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.Zones, strings.ToLower(dns.Fqdn(name)))
+	r.ancestorIdx = nil
+}
+
+// Zone returns the zone stored in Zones for name, normalized the same way as
+// for lookups. Unlike lookups, it does not follow CNAMEs, call
+// Zone.Generate or use Default and scheduled changes.
+func (r *Resolver) Zone(name string) (Zone, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	z, ok := r.Zones[strings.ToLower(dns.Fqdn(name))]
+	return z, ok
+}
+
+// Names returns the names of all zones in Zones, normalized, deduplicated
+// and sorted. Like AddZone, RemoveZone and Zone, it is synchronized with
+// other Resolver methods, but not with direct changes of Zones.
+func (r *Resolver) Names() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	seen := make(map[string]struct{}, len(r.Zones))
+	names := make([]string, 0, len(r.Zones))
+	for name := range r.Zones {
+		name = strings.ToLower(dns.Fqdn(name))
+		if _, ok := seen[name]; ok {
+			continue
+		}
+		seen[name] = struct{}{}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// AddCNAMEChain adds a chain of length CNAME records starting at start and
+// ending at the name with finalZone records. Intermediate names are
+// "link1.start", "link2.start", etc., the final name is "final.start" and
+// is returned. If length is 0, finalZone is added as start.
+func (r *Resolver) AddCNAMEChain(start string, length int, finalZone Zone) string {
+	if r.Zones == nil {
+		r.Zones = make(map[string]Zone)
+	}
+
+	start = strings.ToLower(dns.Fqdn(start))
+	if length <= 0 {
+		r.AddZone(start, finalZone)
+		return start
+	}
+
+	final := "final." + start
+	name := start
+	for i := 1; i < length; i++ {
+		link := fmt.Sprintf("link%d.%s", i, start)
+		r.Zones[name] = Zone{CNAME: link}
+		name = link
+	}
+	r.Zones[name] = Zone{CNAME: final}
+	r.AddZone(final, finalZone)
+
+	return final
 }
 
 func (r *Resolver) lookupA(ctx context.Context, host string) (cname string, addrs []string, err error) {
-	cname, rzone, err := r.targetZone(host)
+	cname, rzone, err := r.targetZone(ctx, host, dns.TypeA)
 	if err != nil {
 		return cname, nil, err
 	}
 
-	return cname, rzone.A, nil
+	addrs = r.order(dns.TypeA, host, sticky(rzone, rzone.A, nil))
+	if err := checkAddrs(dns.TypeA, addrs); err != nil {
+		return cname, nil, err
+	}
+	return cname, addrs, nil
 }
 
 func (r *Resolver) lookupAAAA(ctx context.Context, host string) (cname string, addrs []string, err error) {
-	cname, rzone, err := r.targetZone(host)
+	cname, rzone, err := r.targetZone(ctx, host, dns.TypeAAAA)
 	if err != nil {
 		return cname, nil, err
 	}
 
-	return cname, rzone.AAAA, nil
+	rzone = r.dns64(rzone)
+	addrs = r.order(dns.TypeAAAA, host, sticky(rzone, rzone.AAAA, nil))
+	if err := checkAddrs(dns.TypeAAAA, addrs); err != nil {
+		return cname, nil, err
+	}
+	return cname, addrs, nil
+}
+
+// parseAddr parses addr from Zone.A or Zone.AAAA, depending on qtype. It
+// returns nil if addr is malformed or belongs to the other address family,
+// so that IPv4 addresses in AAAA are not served as IPv4-mapped addresses and
+// IPv6 addresses in A are not served at all.
+func parseAddr(qtype uint16, addr string) net.IP {
+	if strings.Contains(addr, ":") != (qtype == dns.TypeAAAA) {
+		return nil
+	}
+	ip := net.ParseIP(addr)
+	if qtype == dns.TypeA {
+		return ip.To4()
+	}
+	return ip
+}
+
+func checkAddrs(qtype uint16, addrs []string) error {
+	for _, addr := range addrs {
+		if parseAddr(qtype, addr) == nil {
+			return fmt.Errorf("malformed IP in %s records: %v", dns.TypeToString[qtype], addr)
+		}
+	}
+	return nil
+}
+
+// dns64 returns the zone with AAAA records synthesized from A records if
+// DNS64Prefix is set and the zone has no AAAA records.
+func (r *Resolver) dns64(zone Zone) Zone {
+	if r.DNS64Prefix == nil || len(zone.AAAA) != 0 {
+		return zone
+	}
+
+	zone.AAAA = make([]string, 0, len(zone.A))
+	for _, addr := range zone.A {
+		ip := embedIPv4(r.DNS64Prefix, net.ParseIP(addr))
+		if ip == nil {
+			continue
+		}
+		zone.AAAA = append(zone.AAAA, ip.String())
+	}
+	return zone
+}
+
+// embedIPv4 returns the IPv4-embedded IPv6 address (RFC 6052, section 2.2).
+// nil is returned if prefix length is not valid or v4 is not an IPv4
+// address.
+func embedIPv4(prefix *net.IPNet, v4 net.IP) net.IP {
+	ones, bits := prefix.Mask.Size()
+	v4 = v4.To4()
+	if v4 == nil || bits != 128 {
+		return nil
+	}
+	switch ones {
+	case 32, 40, 48, 56, 64, 96:
+	default:
+		return nil
+	}
+
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, prefix.IP.To16())
+	pos := ones / 8
+	for _, b := range v4 {
+		// Bits 64 to 71 (the "u" octet) must be zero.
+		if pos == 8 {
+			ip[pos] = 0
+			pos++
+		}
+		ip[pos] = b
+		pos++
+	}
+	return ip
+}
+
+// sticky returns the single address from addrs selected for the client if
+// zone.Sticky is set. Otherwise addrs are returned as is.
+//
+// The address is selected using FNV-1a hash of the client IP. If client
+// is nil, the first address is used.
+func sticky(zone Zone, addrs []string, client net.IP) []string {
+	if !zone.Sticky || len(addrs) == 0 {
+		return addrs
+	}
+	if client == nil {
+		return addrs[:1]
+	}
+
+	h := fnv.New32a()
+	h.Write(client.To16())
+	i := int(h.Sum32() % uint32(len(addrs)))
+	return addrs[i : i+1]
 }
 
 func (r *Resolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
@@ -162,7 +939,11 @@ func (r *Resolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error)
 }
 
 func (r *Resolver) lookupMX(ctx context.Context, name string) (string, []*net.MX, error) {
-	cname, rzone, err := r.targetZone(name)
+	cname, rzone, err := r.targetZone(ctx, name, dns.TypeMX)
+	if r.useFallback(err) {
+		mx, err := r.Fallback.LookupMX(ctx, name)
+		return "", mx, err
+	}
 	if err != nil {
 		return "", nil, err
 	}
@@ -184,7 +965,11 @@ func (r *Resolver) LookupNS(ctx context.Context, name string) ([]*net.NS, error)
 }
 
 func (r *Resolver) lookupNS(ctx context.Context, name string) (string, []*net.NS, error) {
-	cname, rzone, err := r.targetZone(name)
+	cname, rzone, err := r.targetZone(ctx, name, dns.TypeNS)
+	if r.useFallback(err) {
+		ns, err := r.Fallback.LookupNS(ctx, name)
+		return "", ns, err
+	}
 	if err != nil {
 		return "", nil, err
 	}
@@ -199,17 +984,173 @@ func (r *Resolver) lookupNS(ctx context.Context, name string) (string, []*net.NS
 }
 
 func (r *Resolver) LookupPort(ctx context.Context, network, service string) (port int, err error) {
+	if r.PortErr != nil {
+		return 0, r.PortErr
+	}
 	// TODO: Check whether it can cause problems with net.DefaultResolver hjacking.
 	return net.LookupPort(network, service)
 }
 
 func (r *Resolver) LookupSRV(ctx context.Context, service, proto, name string) (cname string, addrs []*net.SRV, err error) {
-	query := fmt.Sprintf("_%s._%s.%s", service, proto, name)
+	query := name
+	if service != "" || proto != "" {
+		query = fmt.Sprintf("_%s._%s.%s", service, proto, name)
+	}
 	return r.lookupSRV(ctx, query)
 }
 
+// LookupPrefixed looks up records of type qtype for the name built by
+// prepending prefix labels to name, e.g. "_mta-sts" and "example.org" result
+// in "_mta-sts.example.org". It allows to look up records for protocols
+// without dedicated methods.
+//
+// Records are returned as RRs owned by the last name in the CNAME chain.
+func (r *Resolver) LookupPrefixed(ctx context.Context, prefix, name string, qtype uint16) ([]dns.RR, error) {
+	query := strings.TrimSuffix(prefix, ".") + "." + name
+
+	chain, rzone, err := r.followCNAME(ctx, query, qtype)
+	if err != nil {
+		return nil, err
+	}
+	owner := dns.Fqdn(query)
+	if len(chain) != 0 {
+		owner = chain[len(chain)-1]
+	}
+
+	var rrs []dns.RR
+	for _, rr := range zoneRRs(owner, rzone) {
+		if rr.Header().Rrtype == qtype {
+			rrs = append(rrs, rr)
+		}
+	}
+	return rrs, nil
+}
+
+// LookupServiceInstances returns the names of DNS-SD (RFC 6763) service
+// instances listed in PTR records of _service._proto.domain, e.g.
+// "Printer._ipp._tcp.local.". SRV and TXT records of instances can be looked
+// up using LookupSRV("", "", instance) and LookupTXT.
+func (r *Resolver) LookupServiceInstances(ctx context.Context, service, proto, domain string) ([]string, error) {
+	query := fmt.Sprintf("_%s._%s.%s", service, proto, domain)
+	_, rzone, err := r.followCNAME(ctx, query, dns.TypePTR)
+	if err != nil {
+		return nil, err
+	}
+	return r.order(dns.TypePTR, query, rzone.PTR), nil
+}
+
+// ServiceEndpoint is a single SRV record target with its addresses.
+type ServiceEndpoint struct {
+	Target   string
+	Port     uint16
+	Priority uint16
+	Weight   uint16
+
+	// IPs contains A and AAAA records for Target. It is empty if there are
+	// none.
+	IPs []net.IP
+}
+
+// LookupServiceHost does a SRV lookup and then resolves addresses of each
+// target.
+func (r *Resolver) LookupServiceHost(ctx context.Context, service, proto, name string) ([]ServiceEndpoint, error) {
+	_, srvs, err := r.LookupSRV(ctx, service, proto, name)
+	if err != nil {
+		return nil, err
+	}
+
+	endpoints := make([]ServiceEndpoint, 0, len(srvs))
+	for _, srv := range srvs {
+		endp := ServiceEndpoint{
+			Target:   srv.Target,
+			Port:     srv.Port,
+			Priority: srv.Priority,
+			Weight:   srv.Weight,
+		}
+
+		endp.IPs, err = r.hostIPs(ctx, srv.Target)
+		if err != nil {
+			return nil, err
+		}
+
+		endpoints = append(endpoints, endp)
+	}
+
+	return endpoints, nil
+}
+
+// hostIPs returns A and AAAA records for host. Empty slice is returned if
+// host does not exist.
+func (r *Resolver) hostIPs(ctx context.Context, host string) ([]net.IP, error) {
+	addrs4, addrs6, err := r.lookupIP(ctx, host)
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); !ok || !isNotFound(dnsErr) {
+			return nil, err
+		}
+	}
+
+	var ips []net.IP
+	for _, addr := range append(addrs4, addrs6...) {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return nil, fmt.Errorf("malformed IP in records: %v", addr)
+		}
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+// MXHost is a mail exchanger with its addresses.
+type MXHost struct {
+	Host string
+	Pref uint16
+
+	// IPs contains A and AAAA records for Host. It is empty if there are
+	// none.
+	IPs []net.IP
+}
+
+// LookupMXHosts does a MX lookup for domain and then resolves addresses of
+// each mail exchanger, returning them sorted by preference (records with the
+// same preference keep their order). If domain has no MX records, but has
+// addresses, it is returned as the only mail exchanger with preference 0
+// (implicit MX, RFC 5321, section 5.1).
+func (r *Resolver) LookupMXHosts(ctx context.Context, domain string) ([]MXHost, error) {
+	mxs, err := r.LookupMX(ctx, domain)
+	if err != nil {
+		return nil, err
+	}
+	if len(mxs) == 0 {
+		ips, err := r.hostIPs(ctx, domain)
+		if err != nil {
+			return nil, err
+		}
+		if len(ips) == 0 {
+			return nil, notFound(domain)
+		}
+		return []MXHost{{Host: dns.Fqdn(domain), IPs: ips}}, nil
+	}
+
+	sort.SliceStable(mxs, func(i, j int) bool {
+		return mxs[i].Pref < mxs[j].Pref
+	})
+
+	hosts := make([]MXHost, 0, len(mxs))
+	for _, mx := range mxs {
+		ips, err := r.hostIPs(ctx, mx.Host)
+		if err != nil {
+			return nil, err
+		}
+		hosts = append(hosts, MXHost{Host: mx.Host, Pref: mx.Pref, IPs: ips})
+	}
+	return hosts, nil
+}
+
 func (r *Resolver) lookupSRV(ctx context.Context, query string) (cname string, addrs []*net.SRV, err error) {
-	cname, rzone, err := r.targetZone(query)
+	cname, rzone, err := r.targetZone(ctx, query, dns.TypeSRV)
+	if r.useFallback(err) {
+		return r.Fallback.LookupSRV(ctx, "", "", query)
+	}
 	if err != nil {
 		return "", nil, err
 	}
@@ -230,8 +1171,30 @@ func (r *Resolver) LookupTXT(ctx context.Context, name string) ([]string, error)
 	return res, err
 }
 
+// LookupTXTPrefix is similar to LookupTXT but returns only records that start
+// with prefix, e.g. "v=spf1". If the name exists but no records match, the
+// empty slice is returned without an error.
+func (r *Resolver) LookupTXTPrefix(ctx context.Context, name, prefix string) ([]string, error) {
+	_, txt, err := r.lookupTXT(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	res := []string{}
+	for _, rec := range txt {
+		if strings.HasPrefix(rec, prefix) {
+			res = append(res, rec)
+		}
+	}
+	return res, nil
+}
+
 func (r *Resolver) lookupTXT(ctx context.Context, name string) (string, []string, error) {
-	cname, rzone, err := r.targetZone(name)
+	cname, rzone, err := r.targetZone(ctx, name, dns.TypeTXT)
+	if r.useFallback(err) {
+		txt, err := r.Fallback.LookupTXT(ctx, name)
+		return "", txt, err
+	}
 	if err != nil {
 		return "", nil, err
 	}
@@ -258,20 +1221,12 @@ func (r *Resolver) DialContext(ctx context.Context, network, addr string) (net.C
 		return net.Dial(network, addr)
 	}
 
-	_, addrs6, err := r.lookupAAAA(ctx, host)
-	if err != nil {
-		return nil, err
-	}
-	_, addrs4, err := r.lookupA(ctx, host)
+	addrs4, addrs6, err := r.lookupIP(ctx, host)
 	if err != nil {
 		return nil, err
 	}
 	addrs := append(addrs6, addrs4...)
 
-	if len(addrs) == 0 {
-		return nil, notFound(host)
-	}
-
 	var lastErr error
 	for _, addrTry := range addrs {
 		conn, err := net.Dial(network, net.JoinHostPort(addrTry, port))
@@ -2,10 +2,17 @@ package mockdns
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"math/rand"
 	"net"
 	"reflect"
 	"sort"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/miekg/dns"
 )
 
 func TestResolver_LookupHost(t *testing.T) {
@@ -69,3 +76,1028 @@ func TestResolver_LookupHost(t *testing.T) {
 		t.Errorf("Wrong result, want %v, got %v", want, addrs)
 	}
 }
+
+func TestResolver_Generate(t *testing.T) {
+	var queries []dns.Question
+	r := Resolver{Zones: map[string]Zone{
+		"example.org.": {
+			A: []string{"1.1.1.1"},
+			Generate: func(q dns.Question) Zone {
+				queries = append(queries, q)
+				return Zone{
+					A: []string{fmt.Sprintf("10.0.0.%d", len(queries))},
+				}
+			},
+		},
+	}}
+
+	for i := 1; i <= 2; i++ {
+		addrs, err := r.LookupHost(context.Background(), "example.org")
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []string{fmt.Sprintf("10.0.0.%d", 2*i-1)}
+		if !reflect.DeepEqual(addrs, want) {
+			t.Errorf("Wrong result, want %v, got %v", want, addrs)
+		}
+	}
+
+	// LookupHost does A and AAAA lookups.
+	if len(queries) != 4 {
+		t.Fatalf("Generate called %d times, want 4", len(queries))
+	}
+	want := dns.Question{Name: "example.org.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	if queries[0] != want {
+		t.Errorf("Wrong question, want %v, got %v", want, queries[0])
+	}
+}
+
+func TestResolver_TypeDelay(t *testing.T) {
+	r := Resolver{Zones: map[string]Zone{
+		"example.org.": {
+			A:    []string{"1.2.3.4"},
+			AAAA: []string{"::1"},
+			MX:   []net.MX{{Host: "mx.example.org.", Pref: 10}},
+			TypeDelay: map[dns.Type]time.Duration{
+				dns.Type(dns.TypeAAAA): 5 * time.Second,
+			},
+		},
+		"v6.example.org.": {
+			AAAA: []string{"::1"},
+			TypeDelay: map[dns.Type]time.Duration{
+				dns.Type(dns.TypeAAAA): 5 * time.Second,
+			},
+		},
+	}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	// MX lookup is not delayed.
+	if _, err := r.LookupMX(ctx, "example.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	// AAAA lookup times out, but A results are still returned.
+	start := time.Now()
+	addrs, err := r.LookupHost(ctx, "example.org")
+	if time.Since(start) > 1*time.Second {
+		t.Errorf("Delay is not interrupted by context cancellation")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"1.2.3.4"}; !reflect.DeepEqual(addrs, want) {
+		t.Errorf("Wrong result, want %v, got %v", want, addrs)
+	}
+
+	_, err = r.LookupHost(ctx, "v6.example.org")
+	AssertDNSError(t, err, DNSErrorSpec{
+		Name:      "v6.example.org",
+		IsTimeout: true,
+	})
+}
+
+func TestResolver_Timeout(t *testing.T) {
+	r := Resolver{
+		Zones: map[string]Zone{
+			"example.org.": {
+				TXT:   []string{"hello"},
+				Delay: 5 * time.Second,
+			},
+		},
+		Timeout: 50 * time.Millisecond,
+	}
+
+	// Resolver timeout fires first.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	start := time.Now()
+	_, err := r.LookupTXT(ctx, "example.org")
+	if time.Since(start) > 1*time.Second {
+		t.Errorf("Delay is not interrupted by resolver timeout")
+	}
+	AssertDNSError(t, err, DNSErrorSpec{
+		Name:      "example.org",
+		IsTimeout: true,
+	})
+	if dnsErr, ok := err.(*net.DNSError); !ok || dnsErr.Err != "i/o timeout" {
+		t.Errorf("Wrong error: %v", err)
+	}
+
+	// Context deadline fires first.
+	r.Timeout = 2 * time.Second
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	_, err = r.LookupTXT(ctx, "example.org")
+	if time.Since(start) > 1*time.Second {
+		t.Errorf("Delay is not interrupted by context cancellation")
+	}
+	AssertDNSError(t, err, DNSErrorSpec{
+		Name:      "example.org",
+		IsTimeout: true,
+	})
+	if dnsErr, ok := err.(*net.DNSError); !ok || dnsErr.Err != context.DeadlineExceeded.Error() {
+		t.Errorf("Wrong error: %v", err)
+	}
+
+	// Delay shorter than the timeout does not fail.
+	r.Zones["example.org."] = Zone{
+		TXT:   []string{"hello"},
+		Delay: 10 * time.Millisecond,
+	}
+	if _, err := r.LookupTXT(context.Background(), "example.org"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResolver_FailAfter(t *testing.T) {
+	r := Resolver{Zones: map[string]Zone{
+		"example.org.": {
+			TXT:       []string{"hello"},
+			FailAfter: 2,
+		},
+		"other.example.org.": {
+			TXT:       []string{"hello"},
+			FailAfter: 2,
+		},
+	}}
+
+	for i := 0; i < 2; i++ {
+		if _, err := r.LookupTXT(context.Background(), "example.org"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		_, err := r.LookupTXT(context.Background(), "Example.org.")
+		AssertDNSError(t, err, DNSErrorSpec{
+			Name:        "Example.org.",
+			IsTemporary: true,
+		})
+	}
+
+	// Counters are per name.
+	if _, err := r.LookupTXT(context.Background(), "other.example.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	r.ResetCounters()
+	if _, err := r.LookupTXT(context.Background(), "example.org"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResolver_DelayedError(t *testing.T) {
+	r := Resolver{Zones: map[string]Zone{
+		"example.org.": {
+			Err:   &net.DNSError{Err: "server misbehaving", Name: "example.org", IsTemporary: true},
+			Delay: 5 * time.Second,
+		},
+	}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := r.LookupTXT(ctx, "example.org")
+	if time.Since(start) > 1*time.Second {
+		t.Errorf("Delay is not interrupted by context cancellation")
+	}
+	AssertDNSError(t, err, DNSErrorSpec{
+		Name:      "example.org",
+		IsTimeout: true,
+	})
+}
+
+func TestResolver_TypeErr(t *testing.T) {
+	r := Resolver{Zones: map[string]Zone{
+		"example.org.": {
+			A:    []string{"1.2.3.4"},
+			AAAA: []string{"::1"},
+			TypeErr: map[dns.Type]error{
+				dns.Type(dns.TypeAAAA): errors.New("broken IPv6"),
+			},
+		},
+		"v6.example.org.": {
+			AAAA: []string{"::1"},
+			TypeErr: map[dns.Type]error{
+				dns.Type(dns.TypeAAAA): errors.New("broken IPv6"),
+			},
+		},
+	}}
+
+	addrs, err := r.LookupHost(context.Background(), "example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"1.2.3.4"}; !reflect.DeepEqual(addrs, want) {
+		t.Errorf("Wrong result, want %v, got %v", want, addrs)
+	}
+
+	_, err = r.LookupHost(context.Background(), "v6.example.org")
+	if err == nil || err.Error() != "broken IPv6" {
+		t.Fatal("Expected AAAA error, got", err)
+	}
+}
+
+func TestResolver_AddCNAMEChain(t *testing.T) {
+	var r Resolver
+	final := r.AddCNAMEChain("example.org", 5, Zone{
+		A: []string{"1.2.3.4"},
+	})
+	if final != "final.example.org." {
+		t.Errorf("Wrong final name: %v", final)
+	}
+	if len(r.Zones) != 6 {
+		t.Errorf("Wrong amount of zones: %v", len(r.Zones))
+	}
+
+	cname, err := r.LookupCNAME(context.Background(), "example.org.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cname != "link1.example.org." {
+		t.Errorf("Wrong CNAME: %v", cname)
+	}
+
+	addrs, err := r.LookupHost(context.Background(), "example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"1.2.3.4"}; !reflect.DeepEqual(addrs, want) {
+		t.Errorf("Wrong result, want %v, got %v", want, addrs)
+	}
+}
+
+func TestResolver_GenerateCNAMETarget(t *testing.T) {
+	var generated string
+	r := Resolver{Zones: map[string]Zone{
+		"a.example.org.": {CNAME: "b.example.org."},
+		"b.example.org.": {
+			Generate: func(q dns.Question) Zone {
+				if q.Qtype != dns.TypeA {
+					return Zone{}
+				}
+				generated = fmt.Sprintf("10.0.0.%d", rand.Intn(256))
+				return Zone{A: []string{generated}}
+			},
+		},
+		"loop.example.org.": {
+			Generate: func(q dns.Question) Zone {
+				return Zone{CNAME: "Loop.example.org."}
+			},
+		},
+	}}
+
+	for i := 0; i < 3; i++ {
+		cname, addrs, err := r.lookupA(context.Background(), "a.example.org")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cname != "b.example.org." {
+			t.Errorf("Wrong CNAME: %v", cname)
+		}
+		if !reflect.DeepEqual(addrs, []string{generated}) {
+			t.Errorf("Wrong result, want %v, got %v", generated, addrs)
+		}
+	}
+
+	_, err := r.LookupHost(context.Background(), "loop.example.org")
+	AssertDNSError(t, err, DNSErrorSpec{
+		Name: "loop.example.org",
+	})
+}
+
+func TestResolver_CNAMELoop(t *testing.T) {
+	r := Resolver{Zones: map[string]Zone{
+		"a.example.org.": {CNAME: "b.example.org."},
+		"b.example.org.": {CNAME: "A.example.org."},
+	}}
+
+	_, err := r.LookupHost(context.Background(), "a.example.org")
+	AssertDNSError(t, err, DNSErrorSpec{
+		Name: "a.example.org",
+	})
+}
+
+func TestResolver_Root(t *testing.T) {
+	r := Resolver{Zones: map[string]Zone{
+		".": {
+			NS: []net.NS{{Host: "a.root-servers.net."}},
+		},
+	}}
+
+	for _, name := range []string{".", ""} {
+		nss, err := r.LookupNS(context.Background(), name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []*net.NS{{Host: "a.root-servers.net."}}; !reflect.DeepEqual(nss, want) {
+			t.Errorf("Wrong NS for %q", name)
+		}
+	}
+}
+
+func TestResolver_ScheduleChange(t *testing.T) {
+	now := time.Date(2020, 5, 31, 0, 0, 0, 0, time.UTC)
+	r := Resolver{
+		Zones: map[string]Zone{
+			"example.org.": {
+				A: []string{"1.1.1.1"},
+			},
+		},
+		Now: func() time.Time { return now },
+	}
+	r.ScheduleChange("example.org", now.Add(2*time.Hour), Zone{A: []string{"3.3.3.3"}})
+	r.ScheduleChange("Example.org.", now.Add(1*time.Hour), Zone{A: []string{"2.2.2.2"}})
+	r.ScheduleChange("new.example.org", now.Add(1*time.Hour), Zone{A: []string{"4.4.4.4"}})
+
+	check := func(name string, want []string) {
+		t.Helper()
+		addrs, err := r.LookupHost(context.Background(), name)
+		if want == nil {
+			AssertDNSError(t, err, DNSErrorSpec{IsNotFound: true})
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(addrs, want) {
+			t.Errorf("Wrong result, want %v, got %v", want, addrs)
+		}
+	}
+
+	check("example.org", []string{"1.1.1.1"})
+	check("new.example.org", nil)
+
+	now = now.Add(1 * time.Hour)
+	check("example.org", []string{"2.2.2.2"})
+	check("new.example.org", []string{"4.4.4.4"})
+
+	now = now.Add(90 * time.Minute)
+	check("example.org", []string{"3.3.3.3"})
+
+	if !reflect.DeepEqual(r.Zones["example.org."].A, []string{"1.1.1.1"}) {
+		t.Error("Zones map is modified")
+	}
+}
+
+func TestResolver_ScheduleChange_Concurrent(t *testing.T) {
+	start := time.Date(2020, 5, 31, 0, 0, 0, 0, time.UTC)
+	r := Resolver{Now: func() time.Time { return start.Add(time.Hour) }}
+
+	done := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		go func(i int) {
+			defer func() { done <- struct{}{} }()
+			for j := 0; j < 50; j++ {
+				// Schedule changes out of order, so they are sorted.
+				at := start.Add(time.Duration((i*50+j)%7) * time.Minute)
+				r.ScheduleChange("example.org.", at, Zone{A: []string{"1.2.3.4"}})
+				if _, err := r.LookupHost(context.Background(), "example.org"); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+	for i := 0; i < 4; i++ {
+		<-done
+	}
+}
+
+func TestResolver_EmptyNonTerminalIndex(t *testing.T) {
+	r := Resolver{Zones: map[string]Zone{
+		"a.b.example.org.": {A: []string{"1.2.3.4"}},
+	}}
+
+	check := func(name string, want bool) {
+		t.Helper()
+		if got := r.isEmptyNonTerminal(context.Background(), name); got != want {
+			t.Errorf("%s: want %v, got %v", name, want, got)
+		}
+	}
+
+	check("b.example.org.", true)
+	check("example.org.", true)
+	check("a.b.example.org.", false)
+	check("x.example.org.", false)
+
+	// Same amount of zones, but the index is rebuilt.
+	r.RemoveZone("a.b.example.org.")
+	r.AddZone("a.x.example.org.", Zone{A: []string{"1.2.3.4"}})
+	check("b.example.org.", false)
+	check("x.example.org.", true)
+
+	r.Zones["c.d.example.org."] = Zone{A: []string{"1.2.3.4"}}
+	check("d.example.org.", true)
+}
+
+func TestResolver_LookupServiceHost(t *testing.T) {
+	r := Resolver{Zones: map[string]Zone{
+		"_imap._tcp.example.org.": {
+			SRV: []net.SRV{
+				{Target: "mx1.example.org.", Port: 143, Priority: 10, Weight: 1},
+				{Target: "mx2.example.org.", Port: 993, Priority: 20, Weight: 2},
+			},
+		},
+		"mx1.example.org.": {
+			A:    []string{"1.2.3.4"},
+			AAAA: []string{"::1"},
+		},
+	}}
+
+	endpoints, err := r.LookupServiceHost(context.Background(), "imap", "tcp", "example.org.")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []ServiceEndpoint{
+		{
+			Target: "mx1.example.org.", Port: 143, Priority: 10, Weight: 1,
+			IPs: []net.IP{net.ParseIP("1.2.3.4"), net.ParseIP("::1")},
+		},
+		{
+			Target: "mx2.example.org.", Port: 993, Priority: 20, Weight: 2,
+		},
+	}
+	if !reflect.DeepEqual(endpoints, want) {
+		t.Errorf("Wrong result\nwant %+v\n got %+v", want, endpoints)
+	}
+
+	_, err = r.LookupServiceHost(context.Background(), "smtp", "tcp", "example.org.")
+	AssertDNSError(t, err, DNSErrorSpec{IsNotFound: true})
+}
+
+func TestZone_Normalize(t *testing.T) {
+	z := Zone{
+		CNAME: "target.example.org",
+		PTR:   []string{"ptr.example.org", "ptr2.example.org."},
+		MX:    []net.MX{{Host: "mx.example.org", Pref: 10}},
+		NS:    []net.NS{{Host: "ns.example.org"}},
+		SRV:   []net.SRV{{Target: "srv.example.org", Port: 25}},
+	}
+	z.Normalize()
+
+	want := Zone{
+		CNAME: "target.example.org.",
+		PTR:   []string{"ptr.example.org.", "ptr2.example.org."},
+		MX:    []net.MX{{Host: "mx.example.org.", Pref: 10}},
+		NS:    []net.NS{{Host: "ns.example.org."}},
+		SRV:   []net.SRV{{Target: "srv.example.org.", Port: 25}},
+	}
+	if !reflect.DeepEqual(z, want) {
+		t.Errorf("Wrong result\nwant %+v\n got %+v", want, z)
+	}
+
+	var r Resolver
+	r.AddZone("Example.org", Zone{CNAME: "target.example.org"})
+	r.AddZone("target.example.org", Zone{A: []string{"1.2.3.4"}})
+
+	if cname := r.Zones["example.org."].CNAME; cname != "target.example.org." {
+		t.Errorf("CNAME is not normalized: %v", cname)
+	}
+	addrs, err := r.LookupHost(context.Background(), "example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"1.2.3.4"}; !reflect.DeepEqual(addrs, want) {
+		t.Errorf("Wrong result, want %v, got %v", want, addrs)
+	}
+}
+
+func TestResolver_Default(t *testing.T) {
+	r := Resolver{
+		Zones: map[string]Zone{
+			"example.org.": {
+				A: []string{"1.2.3.4"},
+			},
+		},
+		Default: &Zone{
+			A: []string{"5.6.7.8"},
+		},
+	}
+
+	addrs, err := r.LookupHost(context.Background(), "example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(addrs, []string{"1.2.3.4"}) {
+		t.Errorf("Wrong result for existing name: %v", addrs)
+	}
+
+	addrs, err = r.LookupHost(context.Background(), "nonexistent.example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(addrs, []string{"5.6.7.8"}) {
+		t.Errorf("Wrong result for unknown name: %v", addrs)
+	}
+}
+
+func TestResolver_LookupTXTPrefix(t *testing.T) {
+	r := Resolver{Zones: map[string]Zone{
+		"example.org.": {
+			TXT: []string{
+				"google-site-verification=abc",
+				"v=spf1 -all",
+				"v=spf1 include:example.net -all",
+			},
+		},
+	}}
+
+	txt, err := r.LookupTXTPrefix(context.Background(), "example.org", "v=spf1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"v=spf1 -all", "v=spf1 include:example.net -all"}
+	if !reflect.DeepEqual(txt, want) {
+		t.Errorf("Wrong result, want %v, got %v", want, txt)
+	}
+
+	txt, err = r.LookupTXTPrefix(context.Background(), "example.org", "v=DMARC1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if txt == nil || len(txt) != 0 {
+		t.Errorf("Want empty slice, got %#v", txt)
+	}
+
+	_, err = r.LookupTXTPrefix(context.Background(), "nonexistent.example.org", "v=spf1")
+	AssertDNSError(t, err, DNSErrorSpec{
+		Name:       "nonexistent.example.org",
+		IsNotFound: true,
+	})
+}
+
+func TestResolver_Fallback(t *testing.T) {
+	// Server stands in for the real network.
+	srv, err := NewServer(map[string]Zone{
+		"example.org.": {
+			A:   []string{"10.0.0.1"},
+			TXT: []string{"real"},
+		},
+		"real.example.org.": {
+			A:    []string{"10.0.0.2"},
+			AAAA: []string{"2001:db8::2"},
+			MX:   []net.MX{{Host: "mx.example.org.", Pref: 10}},
+			TXT:  []string{"real"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	var real net.Resolver
+	srv.PatchNet(&real)
+
+	r := Resolver{
+		Zones: map[string]Zone{
+			"example.org.": {
+				A: []string{"1.2.3.4"},
+			},
+		},
+		Fallback: &real,
+	}
+
+	// Names in Zones are not looked up using Fallback, even if there
+	// are no records of the type.
+	addrs, err := r.LookupHost(context.Background(), "example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(addrs, []string{"1.2.3.4"}) {
+		t.Errorf("Wrong result for mocked name: %v", addrs)
+	}
+	txt, err := r.LookupTXT(context.Background(), "example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txt) != 0 {
+		t.Errorf("Wrong result for mocked name: %v", txt)
+	}
+
+	addrs, err = r.LookupHost(context.Background(), "real.example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(addrs)
+	if want := []string{"10.0.0.2", "2001:db8::2"}; !reflect.DeepEqual(addrs, want) {
+		t.Errorf("Wrong result for unmatched name, want %v, got %v", want, addrs)
+	}
+	mx, err := r.LookupMX(context.Background(), "real.example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mx) != 1 || mx[0].Host != "mx.example.org." {
+		t.Errorf("Wrong MX result for unmatched name: %v", mx)
+	}
+	txt, err = r.LookupTXT(context.Background(), "real.example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(txt, []string{"real"}) {
+		t.Errorf("Wrong TXT result for unmatched name: %v", txt)
+	}
+
+	_, err = r.LookupHost(context.Background(), "nonexistent.example.org")
+	AssertDNSError(t, err, DNSErrorSpec{
+		Name:       "nonexistent.example.org",
+		IsNotFound: true,
+	})
+}
+
+func TestResolver_ZoneAccessors(t *testing.T) {
+	var r Resolver
+	r.AddZone("WWW.example.org", Zone{CNAME: "example.org"})
+
+	// CNAME target does not exist, but the zone is still returned as is.
+	z, ok := r.Zone("www.Example.org.")
+	if !ok {
+		t.Fatal("Zone is not found")
+	}
+	if z.CNAME != "example.org." {
+		t.Errorf("Wrong zone: %+v", z)
+	}
+
+	if _, ok := r.Zone("example.org"); ok {
+		t.Error("Non-existent zone is found")
+	}
+
+	r.RemoveZone("www.example.org")
+	if _, ok := r.Zone("www.example.org"); ok {
+		t.Error("Zone is found after RemoveZone")
+	}
+}
+
+func TestResolver_Wildcard(t *testing.T) {
+	r := Resolver{Zones: map[string]Zone{
+		"*.example.org.": {
+			A: []string{"1.1.1.1"},
+		},
+		"host.example.org.": {
+			A: []string{"2.2.2.2"},
+		},
+		"c.ent.example.org.": {
+			A: []string{"3.3.3.3"},
+		},
+	}}
+
+	cases := []struct {
+		name string
+		want []string
+	}{
+		// Literal asterisk is the exact key.
+		{"*.example.org", []string{"1.1.1.1"}},
+		{"foo.example.org", []string{"1.1.1.1"}},
+		{"a.b.example.org", []string{"1.1.1.1"}},
+		{"host.example.org", []string{"2.2.2.2"}},
+		// host.example.org is the closest encloser, it has no wildcard.
+		{"a.host.example.org", nil},
+		// ent.example.org is an empty non-terminal and so is the closest
+		// encloser.
+		{"a.ent.example.org", nil},
+		{"ent.example.org", nil},
+		{"example.org", nil},
+	}
+	for _, c := range cases {
+		addrs, err := r.LookupHost(context.Background(), c.name)
+		if c.want == nil {
+			AssertDNSError(t, err, DNSErrorSpec{
+				Name:       c.name,
+				IsNotFound: true,
+			})
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(addrs, c.want) {
+			t.Errorf("%s: want %v, got %v", c.name, c.want, addrs)
+		}
+	}
+}
+
+func TestEmbedIPv4(t *testing.T) {
+	// Examples from RFC 6052, section 2.4.
+	cases := []struct {
+		prefix string
+		want   string
+	}{
+		{"2001:db8::/32", "2001:db8:c000:221::"},
+		{"2001:db8:100::/40", "2001:db8:1c0:2:21::"},
+		{"2001:db8:122::/48", "2001:db8:122:c000:2:2100::"},
+		{"2001:db8:122:300::/56", "2001:db8:122:3c0:0:221::"},
+		{"2001:db8:122:344::/64", "2001:db8:122:344:c0:2:2100:0"},
+		{"2001:db8:122:344::/96", "2001:db8:122:344::c000:221"},
+		{"64:ff9b::/96", "64:ff9b::c000:221"},
+	}
+	for _, c := range cases {
+		_, prefix, err := net.ParseCIDR(c.prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ip := embedIPv4(prefix, net.ParseIP("192.0.2.33"))
+		if ip.String() != c.want {
+			t.Errorf("%s: want %s, got %v", c.prefix, c.want, ip)
+		}
+	}
+
+	_, prefix, _ := net.ParseCIDR("2001:db8::/80")
+	if ip := embedIPv4(prefix, net.ParseIP("192.0.2.33")); ip != nil {
+		t.Errorf("Invalid prefix length is accepted: %v", ip)
+	}
+}
+
+func TestResolver_DNS64(t *testing.T) {
+	_, prefix, _ := net.ParseCIDR("64:ff9b::/96")
+	r := Resolver{
+		Zones: map[string]Zone{
+			"v4.example.org.": {
+				A: []string{"192.0.2.33"},
+			},
+			"dual.example.org.": {
+				A:    []string{"192.0.2.33"},
+				AAAA: []string{"2001:db8::1"},
+			},
+		},
+		DNS64Prefix: prefix,
+	}
+
+	addrs, err := r.LookupHost(context.Background(), "v4.example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"192.0.2.33", "64:ff9b::c000:221"}; !reflect.DeepEqual(addrs, want) {
+		t.Errorf("Wrong result, want %v, got %v", want, addrs)
+	}
+
+	// Native AAAA records suppress synthesis.
+	addrs, err = r.LookupHost(context.Background(), "dual.example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"192.0.2.33", "2001:db8::1"}; !reflect.DeepEqual(addrs, want) {
+		t.Errorf("Wrong result, want %v, got %v", want, addrs)
+	}
+}
+
+func TestResolver_LookupPrefixed(t *testing.T) {
+	r := Resolver{Zones: map[string]Zone{
+		"_mta-sts.example.org.": {
+			TXT: []string{"v=STSv1; id=20190429T010101;"},
+		},
+		"_smtp._tls.example.org.": {
+			CNAME: "tlsrpt.example.net.",
+		},
+		"tlsrpt.example.net.": {
+			TXT: []string{"v=TLSRPTv1; rua=mailto:tlsrpt@example.org"},
+			A:   []string{"1.2.3.4"},
+		},
+	}}
+
+	rrs, err := r.LookupPrefixed(context.Background(), "_mta-sts", "example.org", dns.TypeTXT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rrs) != 1 {
+		t.Fatal("Wrong amount of records:", rrs)
+	}
+	if txt, ok := rrs[0].(*dns.TXT); !ok || txt.Hdr.Name != "_mta-sts.example.org." || txt.Txt[0] != "v=STSv1; id=20190429T010101;" {
+		t.Errorf("Wrong record: %v", rrs[0])
+	}
+
+	rrs, err = r.LookupPrefixed(context.Background(), "_smtp._tls.", "example.org.", dns.TypeTXT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rrs) != 1 {
+		t.Fatal("Wrong amount of records:", rrs)
+	}
+	if txt, ok := rrs[0].(*dns.TXT); !ok || txt.Hdr.Name != "tlsrpt.example.net." {
+		t.Errorf("Wrong record: %v", rrs[0])
+	}
+
+	_, err = r.LookupPrefixed(context.Background(), "_mta-sts", "example.net", dns.TypeTXT)
+	AssertDNSError(t, err, DNSErrorSpec{
+		Name:       "_mta-sts.example.net",
+		IsNotFound: true,
+	})
+}
+
+func TestResolver_LookupServiceInstances(t *testing.T) {
+	r := Resolver{Zones: map[string]Zone{
+		"_http._tcp.local.": {
+			PTR: []string{"Web One._http._tcp.local.", "Web Two._http._tcp.local."},
+		},
+		"web one._http._tcp.local.": {
+			SRV: []net.SRV{{Target: "one.local.", Port: 8080}},
+			TXT: []string{"path=/one"},
+		},
+		"web two._http._tcp.local.": {
+			SRV: []net.SRV{{Target: "two.local.", Port: 8081}},
+			TXT: []string{"path=/two"},
+		},
+	}}
+
+	instances, err := r.LookupServiceInstances(context.Background(), "http", "tcp", "local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"Web One._http._tcp.local.", "Web Two._http._tcp.local."}
+	if !reflect.DeepEqual(instances, want) {
+		t.Fatalf("Wrong instances, want %v, got %v", want, instances)
+	}
+
+	for i, instance := range instances {
+		_, srvs, err := r.LookupSRV(context.Background(), "", "", instance)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(srvs) != 1 || srvs[0].Port != uint16(8080+i) {
+			t.Errorf("%s: wrong SRV records: %v", instance, srvs)
+		}
+		txt, err := r.LookupTXT(context.Background(), instance)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(txt) != 1 || !strings.HasPrefix(txt[0], "path=") {
+			t.Errorf("%s: wrong TXT records: %v", instance, txt)
+		}
+	}
+
+	_, err = r.LookupServiceInstances(context.Background(), "ipp", "tcp", "local")
+	AssertDNSError(t, err, DNSErrorSpec{
+		Name:       "_ipp._tcp.local",
+		IsNotFound: true,
+	})
+}
+
+func TestResolver_AddressFamilies(t *testing.T) {
+	r := Resolver{Zones: map[string]Zone{
+		"both.example.org.": Zone{
+			A:    []string{"1.2.3.4"},
+			AAAA: []string{"2001:db8::1"},
+		},
+		"v4-in-aaaa.example.org.": Zone{
+			AAAA: []string{"1.2.3.4"},
+		},
+		"v6-in-a.example.org.": Zone{
+			A: []string{"2001:db8::1"},
+		},
+	}}
+
+	addrs, err := r.LookupIPAddr(context.Background(), "both.example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 2 || addrs[0].IP.To4() == nil || addrs[1].IP.To4() != nil {
+		t.Errorf("Wrong addresses: %v", addrs)
+	}
+
+	for _, name := range []string{"v4-in-aaaa.example.org", "v6-in-a.example.org"} {
+		addrs, err := r.LookupHost(context.Background(), name)
+		if err == nil {
+			t.Errorf("%s: malformed address is returned: %v", name, addrs)
+		}
+	}
+}
+
+func TestResolver_WarmUp(t *testing.T) {
+	r := Resolver{
+		Zones: map[string]Zone{
+			"example.org.": {
+				TXT:   []string{"hello"},
+				Delay: 200 * time.Millisecond,
+			},
+			"example.com.": {
+				TXT:   []string{"hello"},
+				Delay: 200 * time.Millisecond,
+			},
+		},
+		WarmUp: true,
+	}
+
+	lookup := func(name string) time.Duration {
+		start := time.Now()
+		if _, err := r.LookupTXT(context.Background(), name); err != nil {
+			t.Fatal(err)
+		}
+		return time.Since(start)
+	}
+
+	if d := lookup("example.org"); d < 200*time.Millisecond {
+		t.Errorf("First lookup is not delayed: %v", d)
+	}
+	if d := lookup("EXAMPLE.org."); d >= 200*time.Millisecond {
+		t.Errorf("Second lookup is delayed: %v", d)
+	}
+	if d := lookup("example.com"); d < 200*time.Millisecond {
+		t.Errorf("First lookup of another name is not delayed: %v", d)
+	}
+
+	r.ResetCounters()
+	if d := lookup("example.org"); d < 200*time.Millisecond {
+		t.Errorf("Lookup after ResetCounters is not delayed: %v", d)
+	}
+}
+
+func TestResolver_Names(t *testing.T) {
+	r := Resolver{Zones: map[string]Zone{
+		"www.example.org.": {A: []string{"1.2.3.4"}},
+		"example.org.":     {A: []string{"1.2.3.4"}},
+		"a.example.com.":   {CNAME: "www.example.org."},
+		"WWW.example.org":  {A: []string{"1.2.3.4"}},
+	}}
+	r.AddZone("Mail.Example.ORG", Zone{A: []string{"1.2.3.5"}})
+
+	want := []string{"a.example.com.", "example.org.", "mail.example.org.", "www.example.org."}
+	for i := 0; i < 3; i++ {
+		if names := r.Names(); !reflect.DeepEqual(names, want) {
+			t.Errorf("Wrong names: %v", names)
+		}
+	}
+
+	if names := (&Resolver{}).Names(); len(names) != 0 {
+		t.Errorf("Names are returned for empty resolver: %v", names)
+	}
+
+	// Names is synchronized with AddZone.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			r.AddZone(fmt.Sprintf("host%d.example.org.", i), Zone{A: []string{"1.2.3.4"}})
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		r.Names()
+	}
+	<-done
+	if names := r.Names(); len(names) != len(want)+50 {
+		t.Errorf("Wrong amount of names: %d", len(names))
+	}
+}
+
+func TestResolver_PortErr(t *testing.T) {
+	r := Resolver{}
+	if port, err := r.LookupPort(context.Background(), "tcp", "80"); err != nil || port != 80 {
+		t.Fatalf("Wrong result: %v, %v", port, err)
+	}
+
+	r.PortErr = &net.DNSError{Err: "unknown port", Name: "tcp/foo", IsNotFound: true}
+	_, err := r.LookupPort(context.Background(), "tcp", "80")
+	if err != r.PortErr {
+		t.Errorf("Wrong error: %v", err)
+	}
+}
+
+func TestResolver_LookupMXHosts(t *testing.T) {
+	r := Resolver{Zones: map[string]Zone{
+		"example.org.": {
+			MX: []net.MX{
+				{Host: "mx2.example.org.", Pref: 20},
+				{Host: "mx1.example.org.", Pref: 10},
+				{Host: "mx3.example.org.", Pref: 10},
+				{Host: "mx.example.net.", Pref: 30},
+			},
+		},
+		"mx1.example.org.": {A: []string{"192.0.2.1"}, AAAA: []string{"2001:db8::1"}},
+		"mx2.example.org.": {A: []string{"192.0.2.2"}},
+		"mx3.example.org.": {CNAME: "mx2.example.org."},
+		"example.com.":     {A: []string{"192.0.2.3"}},
+		"example.net.":     {TXT: []string{"no mail"}},
+	}}
+
+	hosts, err := r.LookupMXHosts(context.Background(), "example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []MXHost{
+		{Host: "mx1.example.org.", Pref: 10, IPs: []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")}},
+		{Host: "mx3.example.org.", Pref: 10, IPs: []net.IP{net.ParseIP("192.0.2.2")}},
+		{Host: "mx2.example.org.", Pref: 20, IPs: []net.IP{net.ParseIP("192.0.2.2")}},
+		{Host: "mx.example.net.", Pref: 30},
+	}
+	if !reflect.DeepEqual(hosts, want) {
+		t.Errorf("Wrong MX hosts\nwant %v\n got %v", want, hosts)
+	}
+
+	// Implicit MX.
+	hosts, err = r.LookupMXHosts(context.Background(), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []MXHost{{Host: "example.com.", IPs: []net.IP{net.ParseIP("192.0.2.3")}}}
+	if !reflect.DeepEqual(hosts, want) {
+		t.Errorf("Wrong implicit MX\nwant %v\n got %v", want, hosts)
+	}
+
+	_, err = r.LookupMXHosts(context.Background(), "example.net")
+	AssertDNSError(t, err, DNSErrorSpec{Name: "example.net", IsNotFound: true})
+	_, err = r.LookupMXHosts(context.Background(), "missing.example.net")
+	AssertDNSError(t, err, DNSErrorSpec{IsNotFound: true})
+}
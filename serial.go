@@ -0,0 +1,49 @@
+package mockdns
+
+import (
+	"github.com/miekg/dns"
+)
+
+// IncrementSerial returns the SOA serial incremented by one using the serial
+// number arithmetic (RFC 1982), i.e. 0xFFFFFFFF is followed by 0.
+func IncrementSerial(serial uint32) uint32 {
+	return serial + 1
+}
+
+// SerialLess reports whether serial a precedes serial b according to the
+// serial number arithmetic (RFC 1982). Comparison of serials that differ by
+// exactly 2^31 is undefined by RFC 1982, false is returned then.
+func SerialLess(a, b uint32) bool {
+	if a == b {
+		return false
+	}
+	diff := b - a
+	return diff < 1<<31
+}
+
+// IncrementSerial increments the serial of SOA records in z.Misc using
+// IncrementSerial. Records are copied so the records and the Misc map of
+// other copies of z are not modified. It does nothing if there are no SOA
+// records in z.Misc.
+func (z *Zone) IncrementSerial() {
+	soas := z.Misc[dns.Type(dns.TypeSOA)]
+	if len(soas) == 0 {
+		return
+	}
+
+	misc := make(map[dns.Type][]dns.RR, len(z.Misc))
+	for t, rrs := range z.Misc {
+		misc[t] = rrs
+	}
+
+	updated := make([]dns.RR, len(soas))
+	for i, rr := range soas {
+		rr = dns.Copy(rr)
+		if soa, ok := rr.(*dns.SOA); ok {
+			soa.Serial = IncrementSerial(soa.Serial)
+		}
+		updated[i] = rr
+	}
+	misc[dns.Type(dns.TypeSOA)] = updated
+	z.Misc = misc
+}
@@ -0,0 +1,95 @@
+package mockdns
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestSerial(t *testing.T) {
+	if s := IncrementSerial(0xFFFFFFFF); s != 0 {
+		t.Errorf("IncrementSerial(0xFFFFFFFF) = %d, want 0", s)
+	}
+	if s := IncrementSerial(0x7FFFFFFF); s != 0x80000000 {
+		t.Errorf("IncrementSerial(0x7FFFFFFF) = %d, want 0x80000000", s)
+	}
+
+	cases := []struct {
+		a, b uint32
+		less bool
+	}{
+		{1, 2, true},
+		{2, 1, false},
+		{5, 5, false},
+		{0xFFFFFFFF, 0, true},
+		{0xFFFFFFFF, 1, true},
+		{1, 0xFFFFFFFF, false},
+		{0, 0x7FFFFFFF, true},
+		{0x7FFFFFFF, 0, false},
+		{0, 0x80000000, false},
+		{0x80000000, 0, false},
+		{0xFFFFFFF0, 0x7FFFFFEF, true},
+	}
+	for _, c := range cases {
+		if less := SerialLess(c.a, c.b); less != c.less {
+			t.Errorf("SerialLess(%#x, %#x) = %v, want %v", c.a, c.b, less, c.less)
+		}
+	}
+}
+
+func TestZone_IncrementSerial(t *testing.T) {
+	soa := &dns.SOA{
+		Hdr:    dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600},
+		Ns:     "ns.example.org.",
+		Mbox:   "hostmaster.example.org.",
+		Serial: 0xFFFFFFFF,
+	}
+	orig := Zone{
+		Misc: map[dns.Type][]dns.RR{
+			dns.Type(dns.TypeSOA): {soa},
+		},
+	}
+
+	srv, err := NewServer(map[string]Zone{"example.org.": orig})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	serial := func() uint32 {
+		t.Helper()
+		msg := new(dns.Msg)
+		msg.SetQuestion("example.org.", dns.TypeSOA)
+		reply, err := srv.Exchange(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(reply.Answer) != 1 {
+			t.Fatal("Wrong amount of records in response:", reply.Answer)
+		}
+		return reply.Answer[0].(*dns.SOA).Serial
+	}
+
+	old := serial()
+	z := orig
+	z.IncrementSerial()
+	srv.Resolver().Zones["example.org."] = z
+	updated := serial()
+
+	if updated != 0 {
+		t.Errorf("Wrong serial after increment: %d", updated)
+	}
+	if !SerialLess(old, updated) {
+		t.Errorf("New serial %d does not follow %d", updated, old)
+	}
+	if soa.Serial != 0xFFFFFFFF || orig.Misc[dns.Type(dns.TypeSOA)][0] != soa {
+		t.Error("Original zone is modified")
+	}
+
+	// Zone without SOA records is not changed.
+	z = Zone{A: []string{"1.2.3.4"}}
+	z.IncrementSerial()
+	if z.Misc != nil {
+		t.Errorf("Misc is changed: %v", z.Misc)
+	}
+}
@@ -0,0 +1,89 @@
+package mockdns
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ServeUDP starts serving DNS queries received on pc in the background, in
+// addition to the socket the Server binds itself (that one is still used by
+// PatchNet and LocalAddr).
+//
+// pc is owned by the caller: Close does not close it, but sets its read
+// deadline to the past to stop serving. Reset the deadline to reuse pc
+// afterwards.
+func (s *Server) ServeUDP(pc net.PacketConn) error {
+	return s.serve(&dns.Server{
+		PacketConn: noClosePacketConn{pc},
+		// Decorator also allows generic net.PacketConn to be used.
+		DecorateReader: s.decorateReader,
+	})
+}
+
+// ServeTCP starts serving DNS queries on connections accepted from l in the
+// background, in addition to the listener the Server binds itself.
+//
+// l is owned by the caller: Close does not close it, but sets its deadline to
+// the past to stop serving. Reset the deadline to reuse l afterwards. Because
+// of that, l must have the SetDeadline method, as *net.TCPListener does.
+func (s *Server) ServeTCP(l net.Listener) error {
+	if _, ok := l.(deadlineListener); !ok {
+		return errors.New("mockdns: listener does not support SetDeadline")
+	}
+	return s.serve(&dns.Server{
+		Listener: noCloseListener{l},
+	})
+}
+
+// serve starts srv in the background and waits until it is ready to accept
+// queries.
+func (s *Server) serve(srv *dns.Server) error {
+	s.servMu.Lock()
+	defer s.servMu.Unlock()
+	if s.stopped {
+		return errors.New("mockdns: server is closed")
+	}
+
+	started := make(chan struct{})
+	failed := make(chan error, 1)
+	srv.Handler = s
+	srv.NotifyStartedFunc = func() { close(started) }
+	go func() {
+		failed <- srv.ActivateAndServe()
+	}()
+
+	select {
+	case <-started:
+	case err := <-failed:
+		return err
+	}
+
+	s.extraServs = append(s.extraServs, srv)
+	return nil
+}
+
+type noClosePacketConn struct {
+	net.PacketConn
+}
+
+func (noClosePacketConn) Close() error {
+	return nil
+}
+
+type deadlineListener interface {
+	net.Listener
+	SetDeadline(t time.Time) error
+}
+
+// noCloseListener stops Accept by setting the deadline instead of closing
+// the listener.
+type noCloseListener struct {
+	net.Listener
+}
+
+func (l noCloseListener) Close() error {
+	return l.Listener.(deadlineListener).SetDeadline(time.Unix(1, 0))
+}
@@ -0,0 +1,72 @@
+package mockdns
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestServer_ServeUDPTCP(t *testing.T) {
+	srv, err := NewServer(map[string]Zone{
+		"example.org.": {
+			A: []string{"1.2.3.4"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	if err := srv.ServeUDP(pc); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.ServeTCP(l); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.org.", dns.TypeA)
+	for _, c := range []struct {
+		net  string
+		addr string
+	}{
+		{"udp", pc.LocalAddr().String()},
+		{"tcp", l.Addr().String()},
+	} {
+		cl := dns.Client{Net: c.net, Timeout: 5 * time.Second}
+		reply, _, err := cl.Exchange(msg, c.addr)
+		if err != nil {
+			t.Fatal(c.net, err)
+		}
+		if len(reply.Answer) != 1 {
+			t.Errorf("%s: wrong amount of records in response: %v", c.net, reply.Answer)
+		}
+	}
+
+	srv.Close()
+
+	// Caller-owned sockets are not closed.
+	if err := pc.SetReadDeadline(time.Time{}); err != nil {
+		t.Error("PacketConn is closed:", err)
+	}
+	if err := l.(*net.TCPListener).SetDeadline(time.Time{}); err != nil {
+		t.Error("Listener is closed:", err)
+	}
+
+	if err := srv.ServeUDP(pc); err == nil {
+		t.Error("ServeUDP succeeded after Close")
+	}
+}
@@ -2,10 +2,15 @@ package mockdns
 
 import (
 	"context"
+	"crypto/rand"
 	"errors"
+	"fmt"
 	"log"
 	"net"
 	"os"
+	"strings"
+	"sync"
+	"testing"
 	"time"
 
 	"github.com/miekg/dns"
@@ -14,13 +19,167 @@ import (
 // Server is the wrapper that binds Resolver to the DNS server implementation
 // from github.com/miekg/dns. This allows it to be used as a replacement
 // resolver for testing code that doesn't support DNS callbacks. See PatchNet.
+//
+// Options and Resolver fields must not be modified while the server is
+// running, use NewUnstartedServer to set them before it starts.
 type Server struct {
 	r       Resolver
 	stopped bool
+	ctx     context.Context
+	cancel  context.CancelFunc
 	tcpServ dns.Server
 	udpServ dns.Server
 
+	// servMu protects extraServs and serializes ServeUDP and ServeTCP with
+	// Close.
+	servMu     sync.Mutex
+	extraServs []*dns.Server
+
 	Log Logger
+
+	// Compress controls whether domain name compression is used in
+	// responses. It is enabled by default.
+	Compress bool
+
+	// UDPDelay and TCPDelay specify the delay before sending any response
+	// over the corresponding transport. They are applied after the delays
+	// configured in Zone (which are transport-independent) and after the
+	// response is truncated. This allows, for example, to delay the
+	// truncated UDP response while the TCP retry is fast.
+	UDPDelay time.Duration
+	TCPDelay time.Duration
+
+	// ExpireStart is the time from which the SOA expire timer is counted
+	// down for the EDNS EXPIRE option (RFC 7314) in responses to SOA
+	// queries. The current time is obtained from Resolver.Now. If zero,
+	// the full SOA expire value is reported.
+	ExpireStart time.Time
+
+	// RequireCookie makes the server answer queries with the DNS COOKIE
+	// option (RFC 7873) only if they contain a valid server cookie
+	// previously issued by this server. Otherwise, BADCOOKIE response with a
+	// fresh server cookie is returned. Queries without the option are
+	// answered normally unless RefuseNoCookie is also set, in which case they
+	// are REFUSED.
+	//
+	// Server cookies are always included in responses to queries with the
+	// COOKIE option.
+	RequireCookie  bool
+	RefuseNoCookie bool
+
+	// HijackNX, if set, is served with NOERROR instead of NXDOMAIN
+	// responses, including for non-existent CNAME targets. This simulates
+	// resolvers that redirect non-existent names to a search page. Unlike
+	// Resolver.Default, it applies only to DNS queries and not to names
+	// that are empty non-terminals or below delegations.
+	HijackNX *Zone
+
+	// MinimizeANY makes the server respond to ANY queries with a single
+	// HINFO record as recommended by RFC 8482. Otherwise, all records of
+	// the name are returned.
+	MinimizeANY bool
+
+	// ConditionalAD makes the server set the AD flag for zones with
+	// Zone.AD only if the query has the AD flag or the EDNS DO flag set
+	// (RFC 6840, section 5.7). By default, it is set regardless of the
+	// query flags.
+	ConditionalAD bool
+
+	// EmitCNAMELoops makes the server respond with the looping CNAME chain
+	// and NOERROR instead of SERVFAIL if CNAMEs in Zones form a loop
+	// (including a CNAME pointing to itself). This allows to test loop
+	// detection in clients.
+	EmitCNAMELoops bool
+
+	// Echo makes the server answer TXT queries for names that do not exist
+	// with a TXT record describing the query, e.g.
+	// "name=Example.org. type=TXT client=127.0.0.1". It takes precedence
+	// over HijackNX.
+	Echo bool
+
+	// NoCache sets TTL of all records in responses to 0, including the
+	// records from Zone.Misc that have their own TTL.
+	NoCache bool
+
+	// DecrementTTL makes the server decrement TTLs of records in responses
+	// by the number of seconds passed since CachedAt, like a caching
+	// resolver does. The current time is obtained from Resolver.Now. Once
+	// TTL reaches 0, the record is considered refreshed one second later
+	// and the full TTL is served again. If CachedAt is zero, the time of the
+	// first response with DecrementTTL set is used. NoCache takes
+	// precedence.
+	DecrementTTL bool
+	CachedAt     time.Time
+
+	// AlwaysTruncate makes the server send all UDP responses with the TC
+	// flag set and no records, regardless of their size, so clients have to
+	// retry over TCP. TCP responses are complete.
+	AlwaysTruncate bool
+
+	// AnswerOnly removes the authority and additional sections from
+	// responses, including SOA records in negative responses, glue and the
+	// EDNS OPT record. OPT is kept in responses with extended rcodes, such
+	// as BADCOOKIE, as they cannot be sent without it.
+	AnswerOnly bool
+
+	// OmitQuestion removes the question section from responses, like some
+	// broken servers do.
+	OmitQuestion bool
+
+	// Rewrite, if set, is called for each response before it is sent and
+	// can modify it in place. req is the full query message, so the hook
+	// can branch on any part of it, including the transaction ID
+	// (req.Id). Responses are truncated for UDP after Rewrite is called.
+	Rewrite func(req, reply *dns.Msg)
+
+	// RawBytes, if set, is called with each query received over UDP before
+	// it is parsed. If it returns non-nil, the returned bytes are sent as
+	// the response datagram verbatim and the query is not handled
+	// otherwise. This bypasses all validation and server options, so it can
+	// be used to send malformed, truncated or oversized responses. If it
+	// returns nil, the query is handled normally.
+	RawBytes func(req []byte) []byte
+
+	// Views specify zones served to clients from specific networks. The
+	// first view containing the client address is used. Clients that do not
+	// match any view get Resolver zones.
+	Views []View
+
+	// TCPZones, if set, are used instead of Resolver.Zones and Views for
+	// queries received over TCP, allowing to simulate servers that answer
+	// differently over UDP and TCP. All lookups for the query, including
+	// following of CNAME chains, use the same zones. Other Resolver settings
+	// still apply.
+	TCPZones map[string]Zone
+
+	// QueryACL restricts clients that can query the server. TransferACL
+	// additionally restricts clients that can request zone transfers (AXFR
+	// and IXFR). Queries from clients that are not permitted get REFUSED
+	// responses. Resolver is not affected.
+	//
+	// Note that zone transfers are not implemented, permitted AXFR and IXFR
+	// queries are answered like other queries.
+	QueryACL    ACL
+	TransferACL ACL
+
+	// MaxConcurrent limits the number of queries handled at the same time.
+	// Overload specifies what is done with excess queries. 0 means no
+	// limit.
+	MaxConcurrent int
+	Overload      Overload
+
+	// QueueTimeout is the maximum time a query waits for handling with
+	// OverloadWait. 0 means no limit.
+	QueueTimeout time.Duration
+
+	cookieSecret [16]byte
+
+	statsMu  sync.Mutex
+	stats    Stats
+	released chan struct{}
+
+	cacheStartOnce sync.Once
+	cacheStart     time.Time
 }
 
 type Logger interface {
@@ -32,70 +191,231 @@ func NewServer(zones map[string]Zone) (*Server, error) {
 }
 
 func NewServerWithLogger(zones map[string]Zone, l Logger) (*Server, error) {
+	s := NewUnstartedServer(zones)
+	s.Log = l
+	if err := s.Start(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// NewUnstartedServer creates the server like NewServer, but does not start
+// it, so options can be set before any query is handled. Start must be
+// called before the server is used.
+func NewUnstartedServer(zones map[string]Zone) *Server {
 	s := &Server{
 		r: Resolver{
 			Zones: zones,
 		},
-		tcpServ: dns.Server{Addr: "127.0.0.1:0", Net: "tcp"},
-		udpServ: dns.Server{Addr: "127.0.0.1:0", Net: "udp"},
-		Log:     l,
+		tcpServ:  dns.Server{Addr: "127.0.0.1:0", Net: "tcp"},
+		udpServ:  dns.Server{Addr: "127.0.0.1:0", Net: "udp"},
+		Log:      log.New(os.Stderr, "mockdns server: ", log.LstdFlags),
+		Compress: true,
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	return s
+}
+
+// Start starts the server created using NewUnstartedServer. It should be
+// called only once.
+func (s *Server) Start() error {
+	if _, err := rand.Read(s.cookieSecret[:]); err != nil {
+		return err
 	}
 
 	pconn, err := net.ListenPacket("udp4", "127.0.0.1:0")
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	// Use same endpoint for TCP for simplicity.
 	tcpL, err := net.Listen("tcp4", pconn.LocalAddr().String())
 	if err != nil {
-		return nil, err
+		pconn.Close()
+		return err
 	}
 
 	s.tcpServ.Listener = tcpL
 	s.tcpServ.Handler = s
 	s.udpServ.PacketConn = pconn
 	s.udpServ.Handler = s
+	s.udpServ.DecorateReader = s.decorateReader
 
 	go s.tcpServ.ActivateAndServe()
 	go s.udpServ.ActivateAndServe()
 
-	return s, nil
+	return nil
 }
 
-func (s *Server) writeErr(w dns.ResponseWriter, reply *dns.Msg, err error) {
+func (s *Server) writeErr(w dns.ResponseWriter, req, reply *dns.Msg, err error) {
 	reply.Rcode = dns.RcodeServerFailure
 	reply.RecursionAvailable = false
-	reply.Answer = nil
+	opt := reply.IsEdns0()
 	reply.Extra = nil
+	if opt != nil {
+		reply.Extra = []dns.RR{opt}
+	}
 
-	if dnsErr, ok := err.(*net.DNSError); ok {
-		if isNotFound(dnsErr) {
-			reply.Rcode = dns.RcodeNameError
-			reply.RecursionAvailable = true
-			reply.Ns = []dns.RR{
-				&dns.SOA{
-					Hdr: dns.RR_Header{
-						Name:   dnsErr.Name,
-						Rrtype: dns.TypeSOA,
-						Class:  dns.ClassINET,
-						Ttl:    9999,
-					},
-					Ns:      "localhost.",
-					Mbox:    "hostmaster.localhost.",
-					Serial:  1,
-					Refresh: 900,
-					Retry:   900,
-					Expire:  1800,
-					Minttl:  60,
-				},
+	if dnsErr, ok := err.(*net.DNSError); ok && isNotFound(dnsErr) {
+		// Answer may contain CNAMEs that led to the non-existent name.
+		reply.Rcode = dns.RcodeNameError
+		reply.RecursionAvailable = true
+		reply.Ns = []dns.RR{mkSOA(dnsErr.Name)}
+	} else {
+		reply.Authoritative = false
+		reply.Answer = nil
+		if !ok {
+			s.Log.Printf("lookup error: %v", err)
+		}
+	}
+
+	s.writeMsg(w, req, reply)
+}
+
+// hasType reports whether there is a record of the specified type in rrs.
+func hasType(rrs []dns.RR, rrtype uint16) bool {
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == rrtype {
+			return true
+		}
+	}
+	return false
+}
+
+// isTCP reports whether the query was received over TCP.
+func isTCP(w dns.ResponseWriter) bool {
+	_, ok := w.LocalAddr().(*net.TCPAddr)
+	return ok
+}
+
+// udpSize returns the maximum UDP response size for the query.
+func udpSize(req *dns.Msg) int {
+	if opt := req.IsEdns0(); opt != nil {
+		return int(opt.UDPSize())
+	}
+	return dns.MinMsgSize
+}
+
+// sleep waits for the duration d or until the server is closed.
+func (s *Server) sleep(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-s.ctx.Done():
+	}
+}
+
+// setTTLs replaces the TTL of each record in reply except OPT with f(TTL).
+func setTTLs(reply *dns.Msg, f func(ttl uint32) uint32) {
+	for _, section := range [][]dns.RR{reply.Answer, reply.Ns, reply.Extra} {
+		for i, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
 			}
+			// Copy to not modify records stored in Zone.Misc.
+			rr = dns.Copy(rr)
+			rr.Header().Ttl = f(rr.Header().Ttl)
+			section[i] = rr
+		}
+	}
+}
+
+// cacheAge returns the number of seconds passed since CachedAt for
+// DecrementTTL.
+func (s *Server) cacheAge() uint32 {
+	now := s.r.now()
+	start := s.CachedAt
+	if start.IsZero() {
+		s.cacheStartOnce.Do(func() { s.cacheStart = now })
+		start = s.cacheStart
+	}
+	if now.Before(start) {
+		return 0
+	}
+	return uint32(now.Sub(start) / time.Second)
+}
+
+// decrementTTL returns the TTL of the record cached age seconds ago, which is
+// refreshed each time one second after its TTL reaches 0.
+func decrementTTL(ttl, age uint32) uint32 {
+	return ttl - uint32(uint64(age)%(uint64(ttl)+1))
+}
+
+// writeMsg sends the reply to the client after calling Rewrite, truncating
+// it if it is too big for UDP. The transport-specific delay (UDPDelay or
+// TCPDelay) is applied before sending.
+func (s *Server) writeMsg(w dns.ResponseWriter, req, reply *dns.Msg) {
+	setEdns0(req, reply)
+
+	if s.NoCache {
+		setTTLs(reply, func(uint32) uint32 { return 0 })
+	} else if s.DecrementTTL {
+		age := s.cacheAge()
+		setTTLs(reply, func(ttl uint32) uint32 { return decrementTTL(ttl, age) })
+	}
+
+	if s.AnswerOnly {
+		reply.Ns = nil
+		opt := reply.IsEdns0()
+		reply.Extra = nil
+		if opt != nil && reply.Rcode > 0xF {
+			// Extended rcode (e.g. BADCOOKIE) is stored in OPT, the
+			// response cannot be packed without it.
+			reply.Extra = []dns.RR{opt}
 		}
+	}
+
+	if s.OmitQuestion {
+		reply.Question = nil
+	}
+
+	if s.Rewrite != nil {
+		s.Rewrite(req, reply)
+	}
+
+	if isTCP(w) {
+		s.sleep(s.TCPDelay)
 	} else {
-		s.Log.Printf("lookup error: %v", err)
+		if s.AlwaysTruncate {
+			truncateAll(reply)
+		}
+		reply.Truncate(udpSize(req))
+		s.sleep(s.UDPDelay)
+	}
+
+	reply.Compress = s.Compress
+	if err := w.WriteMsg(reply); err != nil {
+		s.Log.Printf("WriteMsg: %v", err)
 	}
+}
+
+// truncateAll removes all records except OPT from reply and sets the TC
+// flag.
+func truncateAll(reply *dns.Msg) {
+	opt := reply.IsEdns0()
+	reply.Answer, reply.Ns, reply.Extra = nil, nil, nil
+	if opt != nil {
+		reply.Extra = []dns.RR{opt}
+	}
+	reply.Truncated = true
+}
 
-	w.WriteMsg(reply)
+func mkSOA(name string) *dns.SOA {
+	return &dns.SOA{
+		Hdr:     rrHeader(name, dns.TypeSOA),
+		Ns:      "localhost.",
+		Mbox:    "hostmaster.localhost.",
+		Serial:  1,
+		Refresh: 900,
+		Retry:   900,
+		Expire:  1800,
+		Minttl:  60,
+	}
 }
 
 func mkCname(name, cname string) *dns.CNAME {
@@ -110,36 +430,74 @@ func mkCname(name, cname string) *dns.CNAME {
 	}
 }
 
+// splitTXT splits the TXT record value into character-strings of at most
+// 255 bytes and escapes them for dns.TXT. Any bytes are allowed in s.
 func splitTXT(s string) []string {
 	const maxLen = 255
 
+	if len(s) <= maxLen {
+		return []string{escapeTXT(s)}
+	}
+
 	parts := make([]string, 0, len(s)/maxLen+1)
+	for len(s) > maxLen {
+		parts = append(parts, escapeTXT(s[:maxLen]))
+		s = s[maxLen:]
+	}
+	if len(s) != 0 {
+		parts = append(parts, escapeTXT(s))
+	}
 
-	min := func(i, j int) int {
-		if i < j {
-			return i
-		}
-		return j
+	return parts
+}
+
+// escapeTXT escapes the character-string for dns.TXT, which interprets
+// backslash escapes when packing. Other bytes are packed as is.
+func escapeTXT(s string) string {
+	return strings.Replace(s, `\`, `\\`, -1)
+}
+
+// unescapeTXT converts the character-string from dns.TXT (e.g. parsed from a
+// zone file) into raw bytes, decoding \DDD and \X escapes.
+func unescapeTXT(s string) string {
+	if strings.IndexByte(s, '\\') < 0 {
+		return s
 	}
 
-	for i := 0; i < len(s)/maxLen+1; i++ {
-		p := s[i*maxLen : min(len(s), (i+1)*maxLen)]
-		parts = append(parts, p)
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			sb.WriteByte(s[i])
+			continue
+		}
+		i++
+		if i+2 < len(s) && isDigit(s[i]) && isDigit(s[i+1]) && isDigit(s[i+2]) {
+			sb.WriteByte((s[i]-'0')*100 + (s[i+1]-'0')*10 + (s[i+2] - '0'))
+			i += 2
+			continue
+		}
+		sb.WriteByte(s[i])
 	}
+	return sb.String()
+}
 
-	return parts
+func isDigit(b byte) bool {
+	return b >= '0' && b <= '9'
 }
 
 // ServerDNS implements miekg/dns.Handler. It responds with values from underlying
 // Resolver object.
 func (s *Server) ServeDNS(w dns.ResponseWriter, m *dns.Msg) {
+	if !s.acquire(w, m) {
+		return
+	}
+	defer s.release()
+
 	reply := new(dns.Msg)
 
 	if m.MsgHdr.Opcode != dns.OpcodeQuery {
 		reply.SetRcode(m, dns.RcodeRefused)
-		if err := w.WriteMsg(reply); err != nil {
-			s.Log.Printf("WriteMsg: %v", err)
-		}
+		s.writeMsg(w, m, reply)
 		return
 	}
 
@@ -150,221 +508,397 @@ func (s *Server) ServeDNS(w dns.ResponseWriter, m *dns.Msg) {
 
 	if q.Qclass != dns.ClassINET {
 		reply.SetRcode(m, dns.RcodeNotImplemented)
-		if err := w.WriteMsg(reply); err != nil {
-			s.Log.Printf("WriteMsg: %v", err)
-		}
+		s.writeMsg(w, m, reply)
 		return
 	}
 
-	// This does the lookup twice (including lookup* below).
-	// TODO: Avoid this.
-	_, rzone, err := s.r.targetZone(q.Name)
-	if err != nil {
-		s.writeErr(w, reply, err)
+	if !s.checkACL(q, remoteIP(w)) {
+		reply.SetRcode(m, dns.RcodeRefused)
+		s.writeMsg(w, m, reply)
 		return
 	}
-	if rzone.AD {
-		reply.AuthenticatedData = true
+
+	if !s.checkCookie(w, m, reply) {
+		return
 	}
 
-	switch q.Qtype {
-	case dns.TypeA:
-		cname, addrs, err := s.r.lookupA(context.Background(), q.Name)
-		if err != nil {
-			s.writeErr(w, reply, err)
+	qry := query{Question: q, client: remoteIP(w), tcp: isTCP(w), req: m}
+	if err := s.answer(reply, qry); err != nil {
+		s.writeErr(w, m, reply, err)
+		return
+	}
+	s.gateDNSSEC(s.viewContext(qry), m, reply, q.Qtype)
+	if q.Qtype == dns.TypeSOA {
+		s.addExpire(m, reply)
+	}
+	nodata := !hasType(reply.Answer, q.Qtype)
+	if q.Qtype == dns.TypeANY {
+		// No record has type ANY.
+		nodata = len(reply.Answer) == 0
+	}
+	if len(reply.Ns) == 0 && nodata {
+		// NODATA response, add SOA for negative caching.
+		reply.Ns = []dns.RR{mkSOA(q.Name)}
+	}
+
+	s.Log.Printf("DNS TRACE %v", reply.String())
+
+	s.writeMsg(w, m, reply)
+}
+
+func rrHeader(name string, rrtype uint16) dns.RR_Header {
+	return dns.RR_Header{
+		Name:   name,
+		Rrtype: rrtype,
+		Class:  dns.ClassINET,
+		Ttl:    9999,
+	}
+}
+
+// hdr returns the header for records of the zone, using Zone.TTL if it is
+// set.
+func (z Zone) hdr(name string, rrtype uint16) dns.RR_Header {
+	h := rrHeader(name, rrtype)
+	if z.TTL != 0 {
+		h.Ttl = z.TTL
+	}
+	return h
+}
+
+// delegation returns the name and zone of the closest delegation point for
+// name, if there is any.
+func (s *Server) delegation(ctx context.Context, name string) (string, Zone, bool) {
+	return s.closest(ctx, name, func(z Zone) bool { return z.Delegated })
+}
+
+// closest returns the name and zone of the closest ancestor of name
+// (including name itself) with the zone matching f, if there is any.
+func (s *Server) closest(ctx context.Context, name string, f func(Zone) bool) (string, Zone, bool) {
+	name = strings.ToLower(dns.Fqdn(name))
+	zones := s.r.zones(ctx)
+	for _, off := range dns.Split(name) {
+		rzone, ok := zones[name[off:]]
+		if ok && f(rzone) {
+			return name[off:], rzone, true
+		}
+	}
+	return "", Zone{}, false
+}
+
+// lameReferral populates reply with the referral sent by a lame server for
+// the zone.
+func lameReferral(reply *dns.Msg, name string, rzone Zone) {
+	reply.Authoritative = false
+	reply.RecursionAvailable = false
+	if len(rzone.NS) == 0 {
+		reply.Ns = append(reply.Ns, &dns.NS{
+			Hdr: rrHeader(".", dns.TypeNS),
+			Ns:  "a.root-servers.net.",
+		})
+		return
+	}
+	for _, ns := range rzone.NS {
+		reply.Ns = append(reply.Ns, &dns.NS{
+			Hdr: rrHeader(name, dns.TypeNS),
+			Ns:  ns.Host,
+		})
+	}
+}
+
+// referral populates reply with the NS records and glue for the delegation.
+func (s *Server) referral(ctx context.Context, reply *dns.Msg, name string, rzone Zone) {
+	reply.Authoritative = false
+	for _, ns := range rzone.NS {
+		reply.Ns = append(reply.Ns, &dns.NS{
+			Hdr: rrHeader(name, dns.TypeNS),
+			Ns:  ns.Host,
+		})
+
+		if rzone.NoGlue {
+			continue
+		}
+		glue, ok := s.r.zones(ctx)[strings.ToLower(dns.Fqdn(ns.Host))]
+		if !ok {
+			continue
+		}
+		reply.Extra = append(reply.Extra, addressRRs(ns.Host, glue)...)
+	}
+}
+
+// additional adds the addresses of MX or SRV target to the additional
+// section of reply.
+//
+// Targets must not be CNAMEs (RFC 2181, section 10.3), but such
+// configurations exist. CNAME chain is included then and a warning is
+// logged.
+func (s *Server) additional(ctx context.Context, reply *dns.Msg, rrtype uint16, target string) {
+	zones := s.r.zones(ctx)
+	owner := target
+	seen := make(map[string]struct{})
+	for {
+		key := strings.ToLower(dns.Fqdn(owner))
+		if _, ok := seen[key]; ok {
+			return
+		}
+		seen[key] = struct{}{}
+
+		rzone, ok := zones[key]
+		if !ok {
 			return
 		}
+		if rzone.CNAME == "" {
+			reply.Extra = append(reply.Extra, addressRRs(owner, rzone)...)
+			return
+		}
+
+		if owner == target {
+			s.Log.Printf("%s target %s is a CNAME", dns.TypeToString[rrtype], target)
+		}
+		reply.Extra = append(reply.Extra, mkCname(owner, rzone.CNAME))
+		owner = rzone.CNAME
+	}
+}
 
-		if cname != "" {
-			reply.Answer = append(reply.Answer, mkCname(q.Name, cname))
+// addressRRs returns A and AAAA records of the zone with the specified
+// owner name. Malformed addresses are skipped.
+func addressRRs(owner string, rzone Zone) []dns.RR {
+	var rrs []dns.RR
+	for _, addr := range rzone.A {
+		if ip := parseAddr(dns.TypeA, addr); ip != nil {
+			rrs = append(rrs, &dns.A{
+				Hdr: rzone.hdr(owner, dns.TypeA),
+				A:   ip,
+			})
 		}
-		for _, addr := range addrs {
-			parsed := net.ParseIP(addr)
+	}
+	for _, addr := range rzone.AAAA {
+		if ip := parseAddr(dns.TypeAAAA, addr); ip != nil {
+			rrs = append(rrs, &dns.AAAA{
+				Hdr:  rzone.hdr(owner, dns.TypeAAAA),
+				AAAA: ip,
+			})
+		}
+	}
+	return rrs
+}
+
+// query contains the question being answered and information about the
+// client that asked it.
+type query struct {
+	dns.Question
+
+	// client is the IP address of the client. It is nil if unknown.
+	client net.IP
+
+	// tcp is true if the query was received over TCP.
+	tcp bool
+
+	// req is the query message.
+	req *dns.Msg
+}
+
+func remoteIP(w dns.ResponseWriter) net.IP {
+	switch addr := w.RemoteAddr().(type) {
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.TCPAddr:
+		return addr.IP
+	}
+	return nil
+}
+
+// answer populates reply with records for the query q.
+func (s *Server) answer(reply *dns.Msg, q query) error {
+	ctx := s.viewContext(q)
+	// Answers from zones are authoritative, referrals are not.
+	reply.Authoritative = true
+
+	if name, rzone, ok := s.closest(ctx, q.Name, func(z Zone) bool { return z.Lame }); ok {
+		s.r.record(q.Qtype, q.Name)
+		lameReferral(reply, name, rzone)
+		return nil
+	}
+
+	if name, rzone, ok := s.delegation(ctx, q.Name); ok && !(rzone.Recursive && q.req.RecursionDesired) {
+		// DS records are served by the parent side of the delegation.
+		if q.Qtype != dns.TypeDS || !strings.EqualFold(name, dns.Fqdn(q.Name)) {
+			s.r.record(q.Qtype, q.Name)
+			s.referral(ctx, reply, name, rzone)
+			return nil
+		}
+	}
+
+	if s.r.isEmptyNonTerminal(ctx, q.Name) {
+		// Name exists in the tree but has no records, respond with NODATA.
+		s.r.record(q.Qtype, q.Name)
+		return nil
+	}
+
+	if q.Qtype == dns.TypeCNAME {
+		// CNAME is not followed for CNAME queries.
+		s.r.record(q.Qtype, q.Name)
+		rzone, ok := s.r.zone(ctx, q.Name, q.Qtype)
+		if !ok {
+			if s.HijackNX == nil {
+				return notFound(q.Name)
+			}
+			rzone = s.HijackNX.generate(q.Name, q.Qtype)
+		}
+		addEDE(q.req, reply, rzone.EDE)
+		if err := s.r.wait(ctx, q.Name, rzone, q.Qtype); err != nil {
+			return err
+		}
+		if err := s.r.zoneErr(q.Name, rzone, q.Qtype); err != nil {
+			return err
+		}
+		s.setAD(q.req, reply, rzone)
+		if rzone.CNAME != "" {
+			reply.Answer = append(reply.Answer, mkCname(q.Name, rzone.CNAME))
+		}
+		return nil
+	}
+
+	chain, rzone, err := s.r.followCNAME(ctx, q.Name, q.Qtype)
+	if dnsErr, ok := err.(*net.DNSError); ok && isNotFound(dnsErr) {
+		switch {
+		case s.Echo && q.Qtype == dns.TypeTXT:
+			rzone, err = echoZone(dnsErr.Name, q), nil
+		case s.HijackNX != nil:
+			rzone = s.HijackNX.generate(dnsErr.Name, q.Qtype)
+			err = rzone.err(q.Qtype)
+		}
+	}
+	addEDE(q.req, reply, rzone.EDE)
+
+	// Records are owned by the last name in the CNAME chain.
+	owner := q.Name
+	for _, cname := range chain {
+		reply.Answer = append(reply.Answer, mkCname(owner, cname))
+		owner = cname
+	}
+
+	if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.Err == errCNAMELoop && s.EmitCNAMELoops {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	s.setAD(q.req, reply, rzone)
+
+	switch q.Qtype {
+	case dns.TypeA:
+		for _, addr := range s.r.order(dns.TypeA, q.Name, sticky(rzone, rzone.A, q.client)) {
+			parsed := parseAddr(dns.TypeA, addr)
 			if parsed == nil {
-				panic("ServeDNS: malformed IP in records")
+				return fmt.Errorf("malformed IP in A records: %v", addr)
 			}
 			reply.Answer = append(reply.Answer, &dns.A{
-				Hdr: dns.RR_Header{
-					Name:   q.Name,
-					Rrtype: dns.TypeA,
-					Class:  dns.ClassINET,
-					Ttl:    9999,
-				},
-				A: parsed,
+				Hdr: rzone.hdr(owner, dns.TypeA),
+				A:   parsed,
 			})
 		}
 	case dns.TypeAAAA:
-		cname, addrs, err := s.r.lookupAAAA(context.Background(), q.Name)
-		if err != nil {
-			s.writeErr(w, reply, err)
-			return
-		}
-
-		if cname != "" {
-			reply.Answer = append(reply.Answer, mkCname(q.Name, cname))
-		}
-		for _, addr := range addrs {
-			parsed := net.ParseIP(addr)
+		rzone = s.r.dns64(rzone)
+		for _, addr := range s.r.order(dns.TypeAAAA, q.Name, sticky(rzone, rzone.AAAA, q.client)) {
+			parsed := parseAddr(dns.TypeAAAA, addr)
 			if parsed == nil {
-				panic("ServeDNS: malformed IP in records")
+				return fmt.Errorf("malformed IP in AAAA records: %v", addr)
 			}
 			reply.Answer = append(reply.Answer, &dns.AAAA{
-				Hdr: dns.RR_Header{
-					Name:   q.Name,
-					Rrtype: dns.TypeAAAA,
-					Class:  dns.ClassINET,
-					Ttl:    9999,
-				},
+				Hdr:  rzone.hdr(owner, dns.TypeAAAA),
 				AAAA: parsed,
 			})
 		}
 	case dns.TypeMX:
-		cname, mxs, err := s.r.lookupMX(context.Background(), q.Name)
-		if err != nil {
-			s.writeErr(w, reply, err)
-			return
-		}
-
-		if cname != "" {
-			reply.Answer = append(reply.Answer, mkCname(q.Name, cname))
-		}
-		for _, mx := range mxs {
+		for _, mx := range rzone.MX {
 			reply.Answer = append(reply.Answer, &dns.MX{
-				Hdr: dns.RR_Header{
-					Name:   q.Name,
-					Rrtype: dns.TypeMX,
-					Class:  dns.ClassINET,
-					Ttl:    9999,
-				},
+				Hdr:        rzone.hdr(owner, dns.TypeMX),
 				Preference: mx.Pref,
 				Mx:         mx.Host,
 			})
+			s.additional(ctx, reply, dns.TypeMX, mx.Host)
 		}
 	case dns.TypeNS:
-		cname, nss, err := s.r.lookupNS(context.Background(), q.Name)
-		if err != nil {
-			s.writeErr(w, reply, err)
-			return
-		}
-
-		if cname != "" {
-			reply.Answer = append(reply.Answer, mkCname(q.Name, cname))
-		}
-		for _, ns := range nss {
+		for _, ns := range rzone.NS {
 			reply.Answer = append(reply.Answer, &dns.NS{
-				Hdr: dns.RR_Header{
-					Name:   q.Name,
-					Rrtype: dns.TypeNS,
-					Class:  dns.ClassINET,
-					Ttl:    9999,
-				},
-				Ns: ns.Host,
+				Hdr: rzone.hdr(owner, dns.TypeNS),
+				Ns:  ns.Host,
 			})
 		}
 	case dns.TypeSRV:
-		cname, srvs, err := s.r.lookupSRV(context.Background(), q.Name)
-		if err != nil {
-			s.writeErr(w, reply, err)
-			return
-		}
-
-		if cname != "" {
-			reply.Answer = append(reply.Answer, mkCname(q.Name, cname))
-		}
-		for _, srv := range srvs {
+		for _, srv := range rzone.SRV {
 			reply.Answer = append(reply.Answer, &dns.SRV{
-				Hdr: dns.RR_Header{
-					Name:   q.Name,
-					Rrtype: dns.TypeSRV,
-					Class:  dns.ClassINET,
-					Ttl:    9999,
-				},
+				Hdr:      rzone.hdr(owner, dns.TypeSRV),
 				Priority: srv.Priority,
+				Weight:   srv.Weight,
 				Port:     srv.Port,
 				Target:   srv.Target,
 			})
-		}
-	case dns.TypeCNAME:
-		cname, err := s.r.LookupCNAME(context.Background(), q.Name)
-		if err != nil {
-			s.writeErr(w, reply, err)
-			return
-		}
-
-		if cname != "" {
-			reply.Answer = append(reply.Answer, mkCname(q.Name, cname))
+			s.additional(ctx, reply, dns.TypeSRV, srv.Target)
 		}
 	case dns.TypeTXT:
-		cname, txts, err := s.r.lookupTXT(context.Background(), q.Name)
-		if err != nil {
-			s.writeErr(w, reply, err)
-			return
-		}
-
-		if cname != "" {
-			reply.Answer = append(reply.Answer, mkCname(q.Name, cname))
-		}
-		for _, txt := range txts {
+		for _, txt := range rzone.TXT {
 			reply.Answer = append(reply.Answer, &dns.TXT{
-				Hdr: dns.RR_Header{
-					Name:   q.Name,
-					Rrtype: dns.TypeTXT,
-					Class:  dns.ClassINET,
-					Ttl:    9999,
-				},
+				Hdr: rzone.hdr(owner, dns.TypeTXT),
 				Txt: splitTXT(txt),
 			})
 		}
 	case dns.TypePTR:
-		rzone, ok := s.r.Zones[q.Name]
-		if !ok {
-			s.writeErr(w, reply, notFound(q.Name))
-			return
-		}
-
-		for _, name := range rzone.PTR {
+		for _, name := range s.r.order(dns.TypePTR, q.Name, rzone.PTR) {
 			reply.Answer = append(reply.Answer, &dns.PTR{
-				Hdr: dns.RR_Header{
-					Name:   q.Name,
-					Rrtype: dns.TypePTR,
-					Class:  dns.ClassINET,
-					Ttl:    9999,
-				},
+				Hdr: rzone.hdr(owner, dns.TypePTR),
 				Ptr: name,
 			})
 		}
+	case dns.TypeOPENPGPKEY:
+		reply.Answer = append(reply.Answer, openpgpkeyRRs(owner, rzone)...)
+	case dns.TypeSMIMEA:
+		reply.Answer = append(reply.Answer, smimeaRRs(owner, rzone)...)
 	case dns.TypeSOA:
-		reply.Answer = []dns.RR{
-			&dns.SOA{
-				Hdr: dns.RR_Header{
-					Name:   q.Name,
-					Rrtype: dns.TypeSOA,
-					Class:  dns.ClassINET,
-					Ttl:    9999,
-				},
-				Ns:      "localhost.",
-				Mbox:    "hostmaster.localhost.",
-				Serial:  1,
-				Refresh: 900,
-				Retry:   900,
-				Expire:  1800,
-				Minttl:  60,
-			},
+		if soa := rzone.Misc[dns.Type(dns.TypeSOA)]; len(soa) != 0 {
+			reply.Answer = append(reply.Answer, soa...)
+			break
 		}
-	default:
-		rzone, ok := s.r.Zones[q.Name]
-		if !ok {
-			s.writeErr(w, reply, notFound(q.Name))
-			return
+		reply.Answer = append(reply.Answer, mkSOA(owner))
+	case dns.TypeANY:
+		if s.MinimizeANY {
+			reply.Answer = append(reply.Answer, &dns.HINFO{
+				Hdr: rzone.hdr(owner, dns.TypeHINFO),
+				Cpu: "RFC8482",
+			})
+			break
 		}
-
+		reply.Answer = append(reply.Answer, zoneRRs(owner, rzone)...)
+	default:
 		reply.Answer = append(reply.Answer, rzone.Misc[dns.Type(q.Qtype)]...)
 	}
 
-	s.Log.Printf("DNS TRACE %v", reply.String())
+	return nil
+}
 
-	if err := w.WriteMsg(reply); err != nil {
-		s.Log.Printf("WriteMsg: %v", err)
+// setAD sets the AD flag in reply if it is set for rzone. If ConditionalAD is
+// set, the query must also have the AD or DO flag set.
+func (s *Server) setAD(req, reply *dns.Msg, rzone Zone) {
+	if !rzone.AD {
+		return
+	}
+	if s.ConditionalAD && !req.AuthenticatedData {
+		if opt := req.IsEdns0(); opt == nil || !opt.Do() {
+			return
+		}
+	}
+	reply.AuthenticatedData = true
+}
+
+// echoZone returns the zone with the TXT record describing the query for
+// Server.Echo.
+func echoZone(name string, q query) Zone {
+	client := "unknown"
+	if q.client != nil {
+		client = q.client.String()
+	}
+	return Zone{
+		TXT: []string{fmt.Sprintf("name=%s type=%s client=%s", name, dns.TypeToString[q.Qtype], client)},
 	}
 }
 
@@ -380,24 +914,30 @@ func (s *Server) LocalAddr() net.Addr {
 func (s *Server) PatchNet(r *net.Resolver) {
 	r.PreferGo = true
 	r.Dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
-		if s.stopped {
-			return nil, errors.New("Patched resolver is used after Server.Close")
-		}
+		return s.dial(ctx, network)
+	}
+}
 
-		dialer := net.Dialer{
-			// This is localhost, it is either running or not. Fail quickly if
-			// we can't connect.
-			Timeout: 1 * time.Second,
-		}
+// dial connects to the server using the network requested by the patched
+// net.Resolver.
+func (s *Server) dial(ctx context.Context, network string) (net.Conn, error) {
+	if s.stopped {
+		return nil, errors.New("Patched resolver is used after Server.Close")
+	}
 
-		switch network {
-		case "udp", "udp4", "udp6":
-			return dialer.DialContext(ctx, "udp4", s.udpServ.PacketConn.LocalAddr().String())
-		case "tcp", "tcp4", "tcp6":
-			return dialer.DialContext(ctx, "tcp4", s.tcpServ.Listener.Addr().String())
-		default:
-			panic("PatchNet.Dial: unknown network")
-		}
+	dialer := net.Dialer{
+		// This is localhost, it is either running or not. Fail quickly if
+		// we can't connect.
+		Timeout: 1 * time.Second,
+	}
+
+	switch network {
+	case "udp", "udp4", "udp6":
+		return dialer.DialContext(ctx, "udp4", s.udpServ.PacketConn.LocalAddr().String())
+	case "tcp", "tcp4", "tcp6":
+		return dialer.DialContext(ctx, "tcp4", s.tcpServ.Listener.Addr().String())
+	default:
+		panic("PatchNet.Dial: unknown network")
 	}
 }
 
@@ -406,6 +946,22 @@ func UnpatchNet(r *net.Resolver) {
 	r.Dial = nil
 }
 
+// Expect is the same as Resolver.Expect for the underlying Resolver.
+func (s *Server) Expect(qtype uint16, name string) {
+	s.r.Expect(qtype, name)
+}
+
+// Verify is the same as Resolver.Verify for the underlying Resolver.
+func (s *Server) Verify(tb testing.TB) {
+	tb.Helper()
+	s.r.Verify(tb)
+}
+
+// QueryCount is the same as Resolver.QueryCount for the underlying Resolver.
+func (s *Server) QueryCount(qtype uint16, name string) int {
+	return s.r.QueryCount(qtype, name)
+}
+
 // Resolver returns the underlying Resolver object that can be used directly
 // to access Zones content.
 func (s *Server) Resolver() *Resolver {
@@ -413,8 +969,16 @@ func (s *Server) Resolver() *Resolver {
 }
 
 func (s *Server) Close() error {
+	s.cancel()
 	s.tcpServ.Shutdown()
 	s.udpServ.Shutdown()
+
+	s.servMu.Lock()
+	defer s.servMu.Unlock()
+	for _, srv := range s.extraServs {
+		srv.Shutdown()
+	}
+	s.extraServs = nil
 	s.stopped = true
 	return nil
 }
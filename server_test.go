@@ -1,11 +1,17 @@
 package mockdns
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"net"
 	"reflect"
 	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/miekg/dns"
 )
@@ -148,3 +154,1716 @@ func TestServer_LookupTLSA(t *testing.T) {
 		t.Errorf("\nWant %#+v\n got %#+v", rec, reply.Answer[0])
 	}
 }
+
+func TestServer_Generate(t *testing.T) {
+	calls := 0
+	srv, err := NewServer(map[string]Zone{
+		"example.org.": {
+			Generate: func(q dns.Question) Zone {
+				calls++
+				return Zone{
+					A: []string{fmt.Sprintf("10.0.0.%d", calls)},
+				}
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	for i := 1; i <= 2; i++ {
+		msg := new(dns.Msg)
+		msg.SetQuestion("example.org.", dns.TypeA)
+		cl := dns.Client{}
+		reply, _, err := cl.Exchange(msg, srv.LocalAddr().String())
+		if err != nil {
+			t.Fatal("Unexpected error:", err)
+		}
+		if len(reply.Answer) != 1 {
+			t.Fatal("Wrong amount of records in response:", len(reply.Answer))
+		}
+		want := fmt.Sprintf("10.0.0.%d", i)
+		if got := reply.Answer[0].(*dns.A).A.String(); got != want {
+			t.Errorf("Wrong address, want %v, got %v", want, got)
+		}
+	}
+}
+
+func TestServer_EmptyNonTerminal(t *testing.T) {
+	srv, err := NewServer(map[string]Zone{
+		"a.b.c.example.org.": Zone{
+			A: []string{"1.2.3.4"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	test := func(name string, qtype uint16, rcode, answers int) {
+		t.Helper()
+
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, qtype)
+		cl := dns.Client{}
+		reply, _, err := cl.Exchange(msg, srv.LocalAddr().String())
+		if err != nil {
+			t.Fatal("Unexpected error:", err)
+		}
+		if reply.Rcode != rcode {
+			t.Errorf("%s: wrong rcode, want %v, got %v", name, dns.RcodeToString[rcode], dns.RcodeToString[reply.Rcode])
+		}
+		if len(reply.Answer) != answers {
+			t.Errorf("%s: wrong amount of records in response: %v", name, len(reply.Answer))
+		}
+	}
+
+	test("a.b.c.example.org.", dns.TypeA, dns.RcodeSuccess, 1)
+	test("b.c.example.org.", dns.TypeA, dns.RcodeSuccess, 0)
+	test("c.example.org.", dns.TypeA, dns.RcodeSuccess, 0)
+	test("C.Example.Org.", dns.TypeTXT, dns.RcodeSuccess, 0)
+	test("example.org.", dns.TypeMX, dns.RcodeSuccess, 0)
+	test("org.", dns.TypeNS, dns.RcodeSuccess, 0)
+	test("b.example.org.", dns.TypeA, dns.RcodeNameError, 0)
+	test("z.a.b.c.example.org.", dns.TypeA, dns.RcodeNameError, 0)
+	test("bc.example.org.", dns.TypeA, dns.RcodeNameError, 0)
+}
+
+func TestSplitTXT(t *testing.T) {
+	for _, l := range []int{0, 1, 255, 256, 510, 511} {
+		s := strings.Repeat("a", l)
+		parts := splitTXT(s)
+		if strings.Join(parts, "") != s {
+			t.Errorf("%d: parts do not add up to the original string", l)
+		}
+		for i, p := range parts {
+			if len(p) > 255 || (len(p) == 0 && l != 0) {
+				t.Errorf("%d: wrong part %d length: %d", l, i, len(p))
+			}
+		}
+	}
+}
+
+func TestServer_Compress(t *testing.T) {
+	replySize := func(compress bool) int {
+		srv := NewUnstartedServer(map[string]Zone{
+			"example.org.": Zone{
+				NS: []net.NS{
+					{Host: "ns1.example.org."},
+					{Host: "ns2.example.org."},
+					{Host: "ns3.example.org."},
+				},
+			},
+		})
+		srv.Compress = compress
+		if err := srv.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer srv.Close()
+
+		msg := new(dns.Msg)
+		msg.SetQuestion("example.org.", dns.TypeNS)
+		query, err := msg.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		conn, err := net.Dial("udp", srv.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if _, err := conn.Write(query); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 4096)
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		reply := new(dns.Msg)
+		if err := reply.Unpack(buf[:n]); err != nil {
+			t.Fatal(err)
+		}
+		if len(reply.Answer) != 3 {
+			t.Fatal("Wrong amount of records in response:", len(reply.Answer))
+		}
+		return n
+	}
+
+	compressed := replySize(true)
+	uncompressed := replySize(false)
+
+	if compressed >= uncompressed {
+		t.Errorf("Compressed response is not smaller: %d >= %d", compressed, uncompressed)
+	}
+}
+
+func TestServer_TypeDelay(t *testing.T) {
+	srv, err := NewServer(map[string]Zone{
+		"example.org.": Zone{
+			A:    []string{"1.2.3.4"},
+			AAAA: []string{"::1"},
+			TypeDelay: map[dns.Type]time.Duration{
+				dns.Type(dns.TypeAAAA): 500 * time.Millisecond,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	cl := dns.Client{Timeout: 100 * time.Millisecond}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.org.", dns.TypeA)
+	if _, _, err := cl.Exchange(msg, srv.LocalAddr().String()); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+
+	msg.SetQuestion("example.org.", dns.TypeAAAA)
+	_, _, err = cl.Exchange(msg, srv.LocalAddr().String())
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Fatal("Expected timeout, got", err)
+	}
+}
+
+func TestServer_TypeErr(t *testing.T) {
+	srv, err := NewServer(map[string]Zone{
+		"example.org.": Zone{
+			A:    []string{"1.2.3.4"},
+			AAAA: []string{"::1"},
+			TypeErr: map[dns.Type]error{
+				dns.Type(dns.TypeAAAA): errors.New("broken IPv6"),
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.org.", dns.TypeAAAA)
+	cl := dns.Client{}
+	reply, _, err := cl.Exchange(msg, srv.LocalAddr().String())
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if reply.Rcode != dns.RcodeServerFailure {
+		t.Errorf("Wrong rcode, want SERVFAIL, got %v", dns.RcodeToString[reply.Rcode])
+	}
+
+	var r net.Resolver
+	srv.PatchNet(&r)
+
+	addrs, err := r.LookupHost(context.Background(), "example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"1.2.3.4"}; !reflect.DeepEqual(addrs, want) {
+		t.Errorf("Wrong result, want %v, got %v", want, addrs)
+	}
+}
+
+func TestServer_Delegation(t *testing.T) {
+	srv, err := NewServer(map[string]Zone{
+		"example.org.": Zone{
+			Delegated: true,
+			NS:        []net.NS{{Host: "ns1.example.org."}},
+		},
+		"ns1.example.org.": Zone{
+			A: []string{"1.2.3.4"},
+		},
+		"example.net.": Zone{
+			Delegated: true,
+			NoGlue:    true,
+			NS:        []net.NS{{Host: "ns.example.com."}},
+		},
+		"ns.example.com.": Zone{
+			A: []string{"1.2.3.5"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	query := func(name string) *dns.Msg {
+		t.Helper()
+
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeA)
+		cl := dns.Client{}
+		reply, _, err := cl.Exchange(msg, srv.LocalAddr().String())
+		if err != nil {
+			t.Fatal("Unexpected error:", err)
+		}
+		if len(reply.Answer) != 0 {
+			t.Fatal("Referral contains answer records:", reply.Answer)
+		}
+		if len(reply.Ns) != 1 {
+			t.Fatal("Wrong amount of NS records in referral:", len(reply.Ns))
+		}
+		return reply
+	}
+
+	reply := query("www.example.org.")
+	if ns := reply.Ns[0].(*dns.NS); ns.Hdr.Name != "example.org." || ns.Ns != "ns1.example.org." {
+		t.Errorf("Wrong NS record in referral: %v", ns)
+	}
+	if len(reply.Extra) != 1 {
+		t.Fatal("Wrong amount of glue records:", len(reply.Extra))
+	}
+	if a := reply.Extra[0].(*dns.A); a.Hdr.Name != "ns1.example.org." || a.A.String() != "1.2.3.4" {
+		t.Errorf("Wrong glue record: %v", a)
+	}
+
+	reply = query("www.example.net.")
+	if ns := reply.Ns[0].(*dns.NS); ns.Hdr.Name != "example.net." || ns.Ns != "ns.example.com." {
+		t.Errorf("Wrong NS record in referral: %v", ns)
+	}
+	if len(reply.Extra) != 0 {
+		t.Fatal("Glue records present in glueless referral:", reply.Extra)
+	}
+}
+
+func TestServer_DelegationRecursive(t *testing.T) {
+	srv, err := NewServer(map[string]Zone{
+		"example.org.": Zone{
+			Delegated: true,
+			Recursive: true,
+			NS:        []net.NS{{Host: "ns1.example.org."}},
+		},
+		"ns1.example.org.": Zone{
+			A: []string{"1.2.3.4"},
+		},
+		"www.example.org.": Zone{
+			A: []string{"1.2.3.5"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	for _, rd := range []bool{false, true} {
+		msg := new(dns.Msg)
+		msg.SetQuestion("www.example.org.", dns.TypeA)
+		msg.RecursionDesired = rd
+		reply, err := srv.Exchange(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !rd {
+			if len(reply.Answer) != 0 || len(reply.Ns) != 1 || len(reply.Extra) != 1 {
+				t.Errorf("RD=0: wrong referral: %v", reply)
+			}
+			continue
+		}
+		if len(reply.Answer) != 1 || len(reply.Ns) != 0 {
+			t.Fatalf("RD=1: wrong response: %v", reply)
+		}
+		if a := reply.Answer[0].(*dns.A); a.A.String() != "1.2.3.5" {
+			t.Errorf("RD=1: wrong answer: %v", a)
+		}
+	}
+}
+
+func TestServer_Lame(t *testing.T) {
+	srv, err := NewServer(map[string]Zone{
+		"example.org.": Zone{
+			Lame: true,
+			A:    []string{"1.2.3.4"},
+			NS:   []net.NS{{Host: "ns1.example.org."}},
+		},
+		"www.example.org.": Zone{
+			A: []string{"1.2.3.5"},
+		},
+		"example.net.": Zone{
+			Lame: true,
+			A:    []string{"1.2.3.6"},
+		},
+		"example.com.": Zone{
+			A: []string{"1.2.3.7"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	cases := []struct {
+		name  string
+		owner string
+		ns    string
+	}{
+		{"example.org.", "example.org.", "ns1.example.org."},
+		{"www.example.org.", "example.org.", "ns1.example.org."},
+		{"example.net.", ".", "a.root-servers.net."},
+	}
+	for _, c := range cases {
+		msg := new(dns.Msg)
+		msg.SetQuestion(c.name, dns.TypeA)
+		reply, err := srv.Exchange(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reply.Rcode != dns.RcodeSuccess || reply.Authoritative || reply.RecursionAvailable {
+			t.Errorf("%s: wrong header: %v", c.name, reply.MsgHdr)
+		}
+		if len(reply.Answer) != 0 {
+			t.Errorf("%s: lame response contains answer records: %v", c.name, reply.Answer)
+		}
+		if len(reply.Ns) != 1 {
+			t.Fatalf("%s: wrong amount of NS records in referral: %v", c.name, reply.Ns)
+		}
+		if ns := reply.Ns[0].(*dns.NS); ns.Hdr.Name != c.owner || ns.Ns != c.ns {
+			t.Errorf("%s: wrong NS record in referral: %v", c.name, ns)
+		}
+	}
+
+	// Names that are not lame get authoritative answers.
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	reply, err := srv.Exchange(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reply.Authoritative || len(reply.Answer) != 1 {
+		t.Errorf("Wrong response for name that is not lame: %v", reply)
+	}
+}
+
+func TestServer_CNAMEChain(t *testing.T) {
+	exchange := func(loop bool) *dns.Msg {
+		srv := NewUnstartedServer(nil)
+		srv.Resolver().AddCNAMEChain("example.org.", 3, Zone{
+			A: []string{"1.2.3.4"},
+		})
+		if loop {
+			srv.Resolver().Zones["final.example.org."] = Zone{CNAME: "example.org."}
+		}
+		if err := srv.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer srv.Close()
+
+		msg := new(dns.Msg)
+		msg.SetQuestion("example.org.", dns.TypeA)
+		cl := dns.Client{}
+		reply, _, err := cl.Exchange(msg, srv.LocalAddr().String())
+		if err != nil {
+			t.Fatal("Unexpected error:", err)
+		}
+		return reply
+	}
+
+	reply := exchange(false)
+	want := []string{
+		"example.org.\t9999\tIN\tCNAME\tlink1.example.org.",
+		"link1.example.org.\t9999\tIN\tCNAME\tlink2.example.org.",
+		"link2.example.org.\t9999\tIN\tCNAME\tfinal.example.org.",
+		"final.example.org.\t9999\tIN\tA\t1.2.3.4",
+	}
+	var got []string
+	for _, rr := range reply.Answer {
+		got = append(got, rr.String())
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Wrong answer\nwant %q\n got %q", want, got)
+	}
+
+	reply = exchange(true)
+	if reply.Rcode != dns.RcodeServerFailure {
+		t.Errorf("Wrong rcode for CNAME loop, want SERVFAIL, got %v", dns.RcodeToString[reply.Rcode])
+	}
+}
+
+func TestServer_Root(t *testing.T) {
+	soa := &dns.SOA{
+		Hdr:     rrHeader(".", dns.TypeSOA),
+		Ns:      "a.root-servers.net.",
+		Mbox:    "nstld.verisign-grs.com.",
+		Serial:  2020053100,
+		Refresh: 1800,
+		Retry:   900,
+		Expire:  604800,
+		Minttl:  86400,
+	}
+	srv, err := NewServer(map[string]Zone{
+		".": Zone{
+			NS: []net.NS{{Host: "a.root-servers.net."}},
+			Misc: map[dns.Type][]dns.RR{
+				dns.Type(dns.TypeSOA): {soa},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	cl := dns.Client{}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion(".", dns.TypeNS)
+	reply, _, err := cl.Exchange(msg, srv.LocalAddr().String())
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if len(reply.Answer) != 1 {
+		t.Fatal("Wrong amount of records in response:", len(reply.Answer))
+	}
+	if ns := reply.Answer[0].(*dns.NS); ns.Hdr.Name != "." || ns.Ns != "a.root-servers.net." {
+		t.Errorf("Wrong NS record: %v", ns)
+	}
+
+	msg.SetQuestion(".", dns.TypeSOA)
+	reply, _, err = cl.Exchange(msg, srv.LocalAddr().String())
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if len(reply.Answer) != 1 {
+		t.Fatal("Wrong amount of records in response:", len(reply.Answer))
+	}
+	if reply.Answer[0].String() != soa.String() {
+		t.Errorf("\nWant %v\n got %v", soa, reply.Answer[0])
+	}
+}
+
+func TestServer_TransportDelay(t *testing.T) {
+	zone := Zone{}
+	for i := 0; i < 100; i++ {
+		zone.A = append(zone.A, fmt.Sprintf("10.0.0.%d", i))
+	}
+	srv := NewUnstartedServer(map[string]Zone{"example.org.": zone})
+	srv.UDPDelay = 200 * time.Millisecond
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.org.", dns.TypeA)
+
+	udpCl := dns.Client{Net: "udp"}
+	reply, rtt, err := udpCl.Exchange(msg, srv.LocalAddr().String())
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if !reply.Truncated {
+		t.Error("UDP response is not truncated")
+	}
+	if rtt < srv.UDPDelay {
+		t.Errorf("UDP response is not delayed: %v", rtt)
+	}
+
+	tcpCl := dns.Client{Net: "tcp"}
+	reply, rtt, err = tcpCl.Exchange(msg, srv.LocalAddr().String())
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if reply.Truncated || len(reply.Answer) != 100 {
+		t.Errorf("TCP response is truncated: %v records", len(reply.Answer))
+	}
+	if rtt >= srv.UDPDelay {
+		t.Errorf("TCP response is delayed: %v", rtt)
+	}
+}
+
+func TestServer_Sticky(t *testing.T) {
+	zone := Zone{Sticky: true}
+	for i := 0; i < 8; i++ {
+		zone.A = append(zone.A, fmt.Sprintf("10.0.0.%d", i))
+	}
+	srv, err := NewServer(map[string]Zone{"example.org.": zone})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	query := func(client net.IP) string {
+		t.Helper()
+
+		msg := new(dns.Msg)
+		msg.SetQuestion("example.org.", dns.TypeA)
+		w := &memWriter{
+			local:  srv.LocalAddr(),
+			remote: &net.UDPAddr{IP: client, Port: 53},
+		}
+		srv.ServeDNS(w, msg)
+
+		reply := new(dns.Msg)
+		if err := reply.Unpack(w.reply); err != nil {
+			t.Fatal(err)
+		}
+		if len(reply.Answer) != 1 {
+			t.Fatal("Wrong amount of records in response:", len(reply.Answer))
+		}
+		return reply.Answer[0].(*dns.A).A.String()
+	}
+
+	seen := make(map[string]struct{})
+	for i := 1; i <= 20; i++ {
+		client := net.IPv4(192, 0, 2, byte(i))
+		addr := query(client)
+		if again := query(client); again != addr {
+			t.Errorf("%v: different addresses returned: %v, %v", client, addr, again)
+		}
+		seen[addr] = struct{}{}
+	}
+	if len(seen) < 2 {
+		t.Errorf("Same address returned for all clients")
+	}
+
+	addrs, err := srv.Resolver().LookupHost(context.Background(), "example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"10.0.0.0"}; !reflect.DeepEqual(addrs, want) {
+		t.Errorf("Wrong result, want %v, got %v", want, addrs)
+	}
+}
+
+func TestServer_CNAMEWithoutAddress(t *testing.T) {
+	srv, err := NewServer(map[string]Zone{
+		"www.example.org.": Zone{
+			CNAME: "cdn.example.net.",
+		},
+		"cdn.example.net.": Zone{
+			TXT: []string{"no addresses here"},
+		},
+		"broken.example.org.": Zone{
+			CNAME: "missing.example.net.",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("www.example.org.", dns.TypeA)
+	reply, err := srv.Exchange(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Rcode != dns.RcodeSuccess {
+		t.Errorf("Wrong rcode, want NOERROR, got %v", dns.RcodeToString[reply.Rcode])
+	}
+	if len(reply.Answer) != 1 {
+		t.Fatal("Wrong amount of records in response:", len(reply.Answer))
+	}
+	if cname, ok := reply.Answer[0].(*dns.CNAME); !ok || cname.Target != "cdn.example.net." {
+		t.Errorf("Wrong answer record: %v", reply.Answer[0])
+	}
+	if len(reply.Ns) != 1 || reply.Ns[0].Header().Rrtype != dns.TypeSOA {
+		t.Errorf("No SOA in authority section of NODATA response: %v", reply.Ns)
+	}
+
+	// CNAME pointing to non-existent name results in NXDOMAIN with the
+	// CNAME included.
+	msg.SetQuestion("broken.example.org.", dns.TypeA)
+	reply, err = srv.Exchange(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Rcode != dns.RcodeNameError {
+		t.Errorf("Wrong rcode, want NXDOMAIN, got %v", dns.RcodeToString[reply.Rcode])
+	}
+	if len(reply.Answer) != 1 || reply.Answer[0].Header().Rrtype != dns.TypeCNAME {
+		t.Errorf("CNAME is not included in NXDOMAIN response: %v", reply.Answer)
+	}
+
+	r := srv.Resolver()
+	_, err = r.LookupHost(context.Background(), "www.example.org")
+	AssertDNSError(t, err, DNSErrorSpec{IsNotFound: true})
+
+	cname, err := r.LookupCNAME(context.Background(), "www.example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cname != "cdn.example.net." {
+		t.Errorf("Wrong CNAME: %v", cname)
+	}
+}
+
+func TestServer_HijackNX(t *testing.T) {
+	srv, err := NewServer(map[string]Zone{
+		"example.org.": Zone{
+			A: []string{"1.2.3.4"},
+		},
+		"broken.example.org.": Zone{
+			CNAME: "missing.example.net.",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.HijackNX = &Zone{
+		A: []string{"198.51.100.1"},
+	}
+
+	check := func(name string, wantAnswer int) {
+		t.Helper()
+
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeA)
+		reply, err := srv.Exchange(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reply.Rcode != dns.RcodeSuccess {
+			t.Errorf("%s: wrong rcode, want NOERROR, got %v", name, dns.RcodeToString[reply.Rcode])
+		}
+		if len(reply.Answer) != wantAnswer {
+			t.Fatalf("%s: wrong amount of records in response: %v", name, reply.Answer)
+		}
+		a, ok := reply.Answer[wantAnswer-1].(*dns.A)
+		if !ok || a.A.String() != "198.51.100.1" {
+			t.Errorf("%s: wrong answer record: %v", name, reply.Answer[wantAnswer-1])
+		}
+	}
+
+	check("nonexistent.example.org.", 1)
+	check("broken.example.org.", 2)
+
+	// Existing names are not affected.
+	addrs, err := srv.Resolver().LookupHost(context.Background(), "example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(addrs, []string{"1.2.3.4"}) {
+		t.Errorf("Wrong result: %v", addrs)
+	}
+}
+
+func TestServer_ANY(t *testing.T) {
+	srv, err := NewServer(map[string]Zone{
+		"example.org.": Zone{
+			A:   []string{"1.2.3.4"},
+			TXT: []string{"hello"},
+			MX:  []net.MX{{Host: "mx.example.org.", Pref: 10}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.org.", dns.TypeANY)
+	reply, err := srv.Exchange(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.Answer) != 3 {
+		t.Errorf("Wrong amount of records in full ANY response: %v", reply.Answer)
+	}
+	if len(reply.Ns) != 0 {
+		t.Errorf("Authority section in full ANY response: %v", reply.Ns)
+	}
+
+	srv.MinimizeANY = true
+	reply, err = srv.Exchange(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.Answer) != 1 {
+		t.Fatal("Wrong amount of records in minimized ANY response:", reply.Answer)
+	}
+	hinfo, ok := reply.Answer[0].(*dns.HINFO)
+	if !ok {
+		t.Fatalf("Wrong answer record type: %v", reply.Answer[0])
+	}
+	if hinfo.Hdr.Name != "example.org." || hinfo.Cpu != "RFC8482" || hinfo.Os != "" {
+		t.Errorf("Wrong HINFO record: %v", hinfo)
+	}
+	if len(reply.Ns) != 0 {
+		t.Errorf("Authority section in minimized ANY response: %v", reply.Ns)
+	}
+}
+
+func TestServer_FailAfter(t *testing.T) {
+	srv, err := NewServer(map[string]Zone{
+		"example.org.": Zone{
+			A:         []string{"1.2.3.4"},
+			FailAfter: 1,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.org.", dns.TypeA)
+	for i, want := range []int{dns.RcodeSuccess, dns.RcodeServerFailure, dns.RcodeServerFailure} {
+		reply, err := srv.Exchange(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reply.Rcode != want {
+			t.Errorf("%d: wrong rcode, want %v, got %v", i, dns.RcodeToString[want], dns.RcodeToString[reply.Rcode])
+		}
+	}
+
+	srv.Resolver().ResetCounters()
+	reply, err := srv.Exchange(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Rcode != dns.RcodeSuccess {
+		t.Errorf("Wrong rcode after reset: %v", dns.RcodeToString[reply.Rcode])
+	}
+}
+
+func TestServer_Rewrite(t *testing.T) {
+	srv, err := NewServer(map[string]Zone{
+		"example.org.": Zone{
+			A: []string{"1.2.3.4"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	// Odd transaction IDs get a response with the wrong ID.
+	srv.Rewrite = func(req, reply *dns.Msg) {
+		if req.Id%2 == 1 {
+			reply.Id = req.Id + 1
+		}
+	}
+
+	for _, id := range []uint16{10, 11} {
+		msg := new(dns.Msg)
+		msg.SetQuestion("example.org.", dns.TypeA)
+		msg.Id = id
+
+		reply, err := srv.Exchange(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := id
+		if id%2 == 1 {
+			want = id + 1
+		}
+		if reply.Id != want {
+			t.Errorf("Wrong reply ID for query %d: %d", id, reply.Id)
+		}
+		if len(reply.Answer) != 1 {
+			t.Errorf("Wrong amount of records in response: %v", reply.Answer)
+		}
+	}
+}
+
+func TestServer_NoCache(t *testing.T) {
+	soa := &dns.SOA{
+		Hdr:    dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600},
+		Ns:     "ns.example.org.",
+		Mbox:   "hostmaster.example.org.",
+		Serial: 1,
+	}
+	srv, err := NewServer(map[string]Zone{
+		"example.org.": Zone{
+			A: []string{"1.2.3.4"},
+			Misc: map[dns.Type][]dns.RR{
+				dns.Type(dns.TypeSOA): {soa},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.NoCache = true
+
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeSOA, dns.TypeMX} {
+		msg := new(dns.Msg)
+		msg.SetQuestion("example.org.", qtype)
+		reply, err := srv.Exchange(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rrs := append(reply.Answer, reply.Ns...)
+		if len(rrs) == 0 {
+			t.Fatalf("No records in response: %v", reply)
+		}
+		for _, rr := range rrs {
+			if rr.Header().Ttl != 0 {
+				t.Errorf("Non-zero TTL: %v", rr)
+			}
+		}
+	}
+
+	if soa.Hdr.Ttl != 3600 {
+		t.Errorf("Zone record is modified: %v", soa)
+	}
+}
+
+type logRecorder struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *logRecorder) Printf(f string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, fmt.Sprintf(f, args...))
+}
+
+func TestServer_MXTargetCNAME(t *testing.T) {
+	var logs logRecorder
+	srv, err := NewServerWithLogger(map[string]Zone{
+		"example.org.": Zone{
+			MX: []net.MX{{Host: "mx.example.org.", Pref: 10}},
+		},
+		"mx.example.org.": Zone{
+			CNAME: "mail.example.net.",
+		},
+		"mail.example.net.": Zone{
+			A: []string{"1.2.3.4"},
+		},
+	}, &logs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.org.", dns.TypeMX)
+	reply, err := srv.Exchange(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.Answer) != 1 {
+		t.Fatal("Wrong amount of records in response:", reply.Answer)
+	}
+	if len(reply.Extra) != 2 {
+		t.Fatal("Wrong amount of records in additional section:", reply.Extra)
+	}
+	if cname, ok := reply.Extra[0].(*dns.CNAME); !ok || cname.Hdr.Name != "mx.example.org." || cname.Target != "mail.example.net." {
+		t.Errorf("Wrong CNAME in additional section: %v", reply.Extra[0])
+	}
+	if a, ok := reply.Extra[1].(*dns.A); !ok || a.Hdr.Name != "mail.example.net." || a.A.String() != "1.2.3.4" {
+		t.Errorf("Wrong A in additional section: %v", reply.Extra[1])
+	}
+
+	logs.mu.Lock()
+	defer logs.mu.Unlock()
+	found := false
+	for _, line := range logs.lines {
+		if line == "MX target mx.example.org. is a CNAME" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("No warning logged: %v", logs.lines)
+	}
+}
+
+func TestServer_Echo(t *testing.T) {
+	srv := NewUnstartedServer(map[string]Zone{
+		"example.org.": Zone{
+			TXT: []string{"hello"},
+		},
+	})
+	srv.Echo = true
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	var r net.Resolver
+	srv.PatchNet(&r)
+
+	txt, err := r.LookupTXT(context.Background(), "Debug.example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"name=Debug.example.org. type=TXT client=127.0.0.1"}
+	if !reflect.DeepEqual(txt, want) {
+		t.Errorf("Wrong echo, want %v, got %v", want, txt)
+	}
+
+	// Known zones take precedence.
+	txt, err = r.LookupTXT(context.Background(), "example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(txt, []string{"hello"}) {
+		t.Errorf("Wrong result for known name: %v", txt)
+	}
+
+	// Other types are not echoed.
+	_, err = r.LookupHost(context.Background(), "debug.example.org")
+	AssertDNSError(t, err, DNSErrorSpec{
+		Name:       "debug.example.org",
+		IsNotFound: true,
+	})
+}
+
+func TestServer_OmitQuestion(t *testing.T) {
+	exchange := func(omit bool) *dns.Msg {
+		srv := NewUnstartedServer(map[string]Zone{
+			"example.org.": Zone{
+				A: []string{"1.2.3.4"},
+			},
+		})
+		srv.OmitQuestion = omit
+		if err := srv.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer srv.Close()
+
+		msg := new(dns.Msg)
+		msg.SetQuestion("example.org.", dns.TypeA)
+
+		cl := dns.Client{Net: "udp", Timeout: 5 * time.Second}
+		reply, _, err := cl.Exchange(msg, srv.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return reply
+	}
+
+	reply := exchange(false)
+	if len(reply.Question) != 1 {
+		t.Errorf("No question section in normal mode: %v", reply)
+	}
+
+	reply = exchange(true)
+	if len(reply.Question) != 0 {
+		t.Errorf("Question section is present: %v", reply.Question)
+	}
+	if len(reply.Answer) != 1 {
+		t.Errorf("Wrong amount of records in response: %v", reply.Answer)
+	}
+}
+
+func TestServer_DelayedError(t *testing.T) {
+	srv, err := NewServer(map[string]Zone{
+		"example.org.": Zone{
+			Err:   &net.DNSError{Err: "server misbehaving", Name: "example.org", IsTemporary: true},
+			Delay: 200 * time.Millisecond,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.org.", dns.TypeA)
+
+	// SERVFAIL is returned after the delay.
+	start := time.Now()
+	reply, err := srv.Exchange(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) < 200*time.Millisecond {
+		t.Error("SERVFAIL response is not delayed")
+	}
+	if reply.Rcode != dns.RcodeServerFailure {
+		t.Errorf("Wrong rcode, want SERVFAIL, got %v", dns.RcodeToString[reply.Rcode])
+	}
+
+	// Client timeout fires while the SERVFAIL is delayed.
+	var r net.Resolver
+	srv.PatchNet(&r)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = r.LookupTXT(ctx, "example.org")
+	AssertDNSError(t, err, DNSErrorSpec{
+		Name:        "example.org",
+		IsTimeout:   true,
+		IsTemporary: true,
+	})
+}
+
+func TestServer_LargeTXT(t *testing.T) {
+	big := strings.Repeat("0123456789", 6000)
+	srv, err := NewServer(map[string]Zone{
+		"example.org.": Zone{
+			TXT: []string{big},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.org.", dns.TypeTXT)
+
+	cl := dns.Client{Net: "tcp", Timeout: 5 * time.Second}
+	reply, _, err := cl.Exchange(msg, srv.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Truncated {
+		t.Error("TC flag is set for TCP response")
+	}
+	if len(reply.Answer) != 1 {
+		t.Fatal("Wrong amount of records in response:", reply.Answer)
+	}
+	if txt := strings.Join(reply.Answer[0].(*dns.TXT).Txt, ""); txt != big {
+		t.Errorf("Wrong TXT record, got %d bytes", len(txt))
+	}
+
+	cl.Net = "udp"
+	msg.SetEdns0(4096, false)
+	reply, _, err = cl.Exchange(msg, srv.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reply.Truncated {
+		t.Error("TC flag is not set for UDP response")
+	}
+	if len(reply.Answer) != 0 {
+		t.Errorf("Wrong amount of records in truncated response: %d", len(reply.Answer))
+	}
+
+	// net.Resolver retries over TCP.
+	var r net.Resolver
+	srv.PatchNet(&r)
+	txt, err := r.LookupTXT(context.Background(), "example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txt) != 1 || txt[0] != big {
+		t.Errorf("Wrong TXT record from net.Resolver")
+	}
+}
+
+func TestServer_EmitCNAMELoops(t *testing.T) {
+	srv, err := NewServer(map[string]Zone{
+		"a.example.org.": Zone{
+			CNAME: "a.example.org.",
+		},
+		"b.example.org.": Zone{
+			CNAME: "c.example.org.",
+		},
+		"c.example.org.": Zone{
+			CNAME: "b.example.org.",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("a.example.org.", dns.TypeA)
+	reply, err := srv.Exchange(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Rcode != dns.RcodeServerFailure {
+		t.Errorf("Wrong rcode by default, want SERVFAIL, got %v", dns.RcodeToString[reply.Rcode])
+	}
+
+	srv.EmitCNAMELoops = true
+
+	reply, err = srv.Exchange(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Rcode != dns.RcodeSuccess {
+		t.Errorf("Wrong rcode, want NOERROR, got %v", dns.RcodeToString[reply.Rcode])
+	}
+	if len(reply.Answer) != 1 {
+		t.Fatal("Wrong amount of records in response:", reply.Answer)
+	}
+	if cname, ok := reply.Answer[0].(*dns.CNAME); !ok || cname.Hdr.Name != "a.example.org." || cname.Target != "a.example.org." {
+		t.Errorf("Wrong answer record: %v", reply.Answer[0])
+	}
+
+	msg.SetQuestion("b.example.org.", dns.TypeA)
+	reply, err = srv.Exchange(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"b.example.org. c.example.org.", "c.example.org. b.example.org."}
+	var got []string
+	for _, rr := range reply.Answer {
+		cname := rr.(*dns.CNAME)
+		got = append(got, cname.Hdr.Name+" "+cname.Target)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Wrong CNAME chain, want %v, got %v", want, got)
+	}
+}
+
+func TestServer_ConditionalAD(t *testing.T) {
+	srv, err := NewServer(map[string]Zone{
+		"example.org.": Zone{
+			A:  []string{"1.2.3.4"},
+			AD: true,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	cases := []struct {
+		ad, do      bool
+		conditional bool
+		want        bool
+	}{
+		{ad: false, do: false, conditional: false, want: true},
+		{ad: false, do: false, conditional: true, want: false},
+		{ad: true, do: false, conditional: true, want: true},
+		{ad: false, do: true, conditional: true, want: true},
+		{ad: true, do: true, conditional: true, want: true},
+	}
+	for _, c := range cases {
+		srv.ConditionalAD = c.conditional
+
+		msg := new(dns.Msg)
+		msg.SetQuestion("example.org.", dns.TypeA)
+		msg.AuthenticatedData = c.ad
+		if c.do {
+			msg.SetEdns0(4096, true)
+		}
+		reply, err := srv.Exchange(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reply.AuthenticatedData != c.want {
+			t.Errorf("AD=%v DO=%v ConditionalAD=%v: want AD %v, got %v",
+				c.ad, c.do, c.conditional, c.want, reply.AuthenticatedData)
+		}
+	}
+}
+
+func TestServer_EDNSUDPSize(t *testing.T) {
+	zone := Zone{}
+	for i := 0; i < 40; i++ {
+		zone.A = append(zone.A, fmt.Sprintf("10.0.0.%d", i))
+	}
+	srv, err := NewServer(map[string]Zone{"example.org.": zone})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	cl := dns.Client{Net: "udp", Timeout: 5 * time.Second}
+
+	// Without EDNS, response is limited to 512 bytes.
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.org.", dns.TypeA)
+	reply, _, err := cl.Exchange(msg, srv.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reply.Truncated {
+		t.Error("Response to non-EDNS query is not truncated")
+	}
+	reply.Compress = true
+	if reply.Len() > dns.MinMsgSize {
+		t.Errorf("Response to non-EDNS query is too big: %d", reply.Len())
+	}
+
+	// EDNS client advertising 4096 bytes gets the full response.
+	msg.SetEdns0(4096, false)
+	reply, _, err = cl.Exchange(msg, srv.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Truncated || len(reply.Answer) != 40 {
+		t.Errorf("Response to EDNS query is truncated: %v records", len(reply.Answer))
+	}
+	if reply.Len() <= dns.MinMsgSize {
+		t.Errorf("Response is not bigger than 512 bytes: %d", reply.Len())
+	}
+}
+
+func TestServer_WildcardLiteral(t *testing.T) {
+	srv, err := NewServer(map[string]Zone{
+		"*.example.org.": Zone{
+			TXT: []string{"wildcard"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	for _, name := range []string{"*.example.org.", "foo.example.org."} {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeTXT)
+		reply, err := srv.Exchange(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(reply.Answer) != 1 {
+			t.Fatalf("%s: wrong amount of records in response: %v", name, reply.Answer)
+		}
+		if owner := reply.Answer[0].Header().Name; owner != name {
+			t.Errorf("%s: wrong owner name: %v", name, owner)
+		}
+	}
+}
+
+func TestServer_DNS64(t *testing.T) {
+	srv, err := NewServer(map[string]Zone{
+		"example.org.": Zone{
+			A: []string{"192.0.2.33"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	_, srv.Resolver().DNS64Prefix, _ = net.ParseCIDR("64:ff9b::/96")
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.org.", dns.TypeAAAA)
+	reply, err := srv.Exchange(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.Answer) != 1 {
+		t.Fatal("Wrong amount of records in response:", reply.Answer)
+	}
+	if aaaa, ok := reply.Answer[0].(*dns.AAAA); !ok || aaaa.AAAA.String() != "64:ff9b::c000:221" {
+		t.Errorf("Wrong answer record: %v", reply.Answer[0])
+	}
+}
+
+func TestServer_AnswerOnly(t *testing.T) {
+	srv, err := NewServer(map[string]Zone{
+		"example.org.": Zone{
+			MX: []net.MX{{Host: "mx.example.org.", Pref: 10}},
+		},
+		"mx.example.org.": Zone{
+			A: []string{"1.2.3.4"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.AnswerOnly = true
+
+	cases := []struct {
+		name   string
+		qtype  uint16
+		answer int
+	}{
+		{"example.org.", dns.TypeMX, 1},
+		{"example.org.", dns.TypeA, 0},
+		{"nonexistent.example.org.", dns.TypeA, 0},
+	}
+	for _, c := range cases {
+		msg := new(dns.Msg)
+		msg.SetQuestion(c.name, c.qtype)
+		msg.SetEdns0(4096, false)
+		reply, err := srv.Exchange(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(reply.Answer) != c.answer {
+			t.Errorf("%s %s: wrong amount of records in answer section: %v", c.name, dns.TypeToString[c.qtype], reply.Answer)
+		}
+		if len(reply.Ns) != 0 || len(reply.Extra) != 0 {
+			t.Errorf("%s %s: non-empty authority or additional section: %v", c.name, dns.TypeToString[c.qtype], reply)
+		}
+	}
+}
+
+func TestServer_RawBytes(t *testing.T) {
+	srv := NewUnstartedServer(map[string]Zone{
+		"example.org.": Zone{
+			A: []string{"1.2.3.4"},
+		},
+		"raw.example.org.": Zone{
+			A: []string{"1.2.3.4"},
+		},
+	})
+
+	// Transaction ID followed by a truncated header.
+	srv.RawBytes = func(req []byte) []byte {
+		if !bytes.Contains(req, []byte("\x03raw")) {
+			return nil
+		}
+		return append(req[:2:2], 0x81, 0x80, 0x00)
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	exchange := func(name string) []byte {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeA)
+		query, err := msg.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		conn, err := net.Dial("udp", srv.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if _, err := conn.Write(query); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 4096)
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf[:2], query[:2]) {
+			t.Fatalf("Wrong reply ID: %x", buf[:2])
+		}
+		return buf[:n]
+	}
+
+	if resp := exchange("raw.example.org."); len(resp) != 5 {
+		t.Errorf("Wrong raw response: %x", resp)
+	}
+
+	reply := new(dns.Msg)
+	if err := reply.Unpack(exchange("example.org.")); err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.Answer) != 1 {
+		t.Errorf("Wrong amount of records in response: %v", reply.Answer)
+	}
+}
+
+func TestServer_AddressFamilies(t *testing.T) {
+	var logs logRecorder
+	srv, err := NewServerWithLogger(map[string]Zone{
+		"both.example.org.": Zone{
+			A:    []string{"1.2.3.4"},
+			AAAA: []string{"2001:db8::1"},
+		},
+		"v4.example.org.": Zone{
+			A: []string{"1.2.3.4"},
+		},
+		"v6.example.org.": Zone{
+			AAAA: []string{"2001:db8::1"},
+		},
+		"v4-in-aaaa.example.org.": Zone{
+			AAAA: []string{"1.2.3.4"},
+		},
+		"v6-in-a.example.org.": Zone{
+			A: []string{"2001:db8::1"},
+		},
+	}, &logs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	cases := []struct {
+		name  string
+		qtype uint16
+		rcode int
+		addrs []string
+	}{
+		{"both.example.org.", dns.TypeA, dns.RcodeSuccess, []string{"1.2.3.4"}},
+		{"both.example.org.", dns.TypeAAAA, dns.RcodeSuccess, []string{"2001:db8::1"}},
+		{"v4.example.org.", dns.TypeA, dns.RcodeSuccess, []string{"1.2.3.4"}},
+		{"v4.example.org.", dns.TypeAAAA, dns.RcodeSuccess, nil},
+		{"v6.example.org.", dns.TypeA, dns.RcodeSuccess, nil},
+		{"v6.example.org.", dns.TypeAAAA, dns.RcodeSuccess, []string{"2001:db8::1"}},
+		{"v4-in-aaaa.example.org.", dns.TypeA, dns.RcodeSuccess, nil},
+		{"v4-in-aaaa.example.org.", dns.TypeAAAA, dns.RcodeServerFailure, nil},
+		{"v6-in-a.example.org.", dns.TypeA, dns.RcodeServerFailure, nil},
+		{"v6-in-a.example.org.", dns.TypeAAAA, dns.RcodeSuccess, nil},
+	}
+	for _, c := range cases {
+		msg := new(dns.Msg)
+		msg.SetQuestion(c.name, c.qtype)
+		reply, err := srv.Exchange(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reply.Rcode != c.rcode {
+			t.Errorf("%s %s: wrong rcode: %s", c.name, dns.TypeToString[c.qtype], dns.RcodeToString[reply.Rcode])
+		}
+
+		var addrs []string
+		for _, rr := range reply.Answer {
+			if rr.Header().Rrtype != c.qtype {
+				t.Errorf("%s %s: wrong record type in answer: %v", c.name, dns.TypeToString[c.qtype], rr)
+				continue
+			}
+			switch rr := rr.(type) {
+			case *dns.A:
+				if len(rr.A) != net.IPv4len {
+					t.Errorf("%s: non-IPv4 address in A record: %v", c.name, rr.A)
+				}
+				addrs = append(addrs, rr.A.String())
+			case *dns.AAAA:
+				addrs = append(addrs, rr.AAAA.String())
+			}
+		}
+		if !reflect.DeepEqual(addrs, c.addrs) {
+			t.Errorf("%s %s: wrong addresses: %v", c.name, dns.TypeToString[c.qtype], addrs)
+		}
+	}
+
+	malformed := 0
+	for _, line := range logs.lines {
+		if strings.Contains(line, "malformed IP") {
+			malformed++
+		}
+	}
+	if malformed != 2 {
+		t.Errorf("Malformed addresses are not logged: %v", logs.lines)
+	}
+}
+
+func TestServer_SVCBKeys(t *testing.T) {
+	const file = `$TTL 3600
+@	IN	HTTPS	1 . mandatory=alpn,key65000 alpn=h2,h3 key65000="opaque\001" key65001=""
+_dns	IN	SVCB	1 dns.example.org. mandatory=port port=853 key667="hello"
+`
+	zones, err := ParseZone(strings.NewReader(file), "example.org", "example.org.zone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := NewServer(zones)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	cases := []struct {
+		name  string
+		qtype uint16
+		want  []dns.SVCBKeyValue
+	}{
+		{"example.org.", dns.TypeHTTPS, []dns.SVCBKeyValue{
+			&dns.SVCBMandatory{Code: []dns.SVCBKey{dns.SVCB_ALPN, 65000}},
+			&dns.SVCBAlpn{Alpn: []string{"h2", "h3"}},
+			&dns.SVCBLocal{KeyCode: 65000, Data: []byte("opaque\x01")},
+			&dns.SVCBLocal{KeyCode: 65001, Data: []byte{}},
+		}},
+		{"_dns.example.org.", dns.TypeSVCB, []dns.SVCBKeyValue{
+			&dns.SVCBMandatory{Code: []dns.SVCBKey{dns.SVCB_PORT}},
+			&dns.SVCBPort{Port: 853},
+			&dns.SVCBLocal{KeyCode: 667, Data: []byte("hello")},
+		}},
+	}
+	for _, c := range cases {
+		msg := new(dns.Msg)
+		msg.SetQuestion(c.name, c.qtype)
+		cl := dns.Client{}
+		reply, _, err := cl.Exchange(msg, srv.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(reply.Answer) != 1 {
+			t.Fatalf("%s: wrong amount of records in response: %v", c.name, reply.Answer)
+		}
+
+		var svcb *dns.SVCB
+		switch rr := reply.Answer[0].(type) {
+		case *dns.HTTPS:
+			svcb = &rr.SVCB
+		case *dns.SVCB:
+			svcb = rr
+		default:
+			t.Fatalf("%s: wrong record: %v", c.name, rr)
+		}
+		if len(svcb.Value) != len(c.want) {
+			t.Fatalf("%s: wrong params: %v", c.name, svcb)
+		}
+		for i, kv := range svcb.Value {
+			if kv.Key() != c.want[i].Key() || kv.String() != c.want[i].String() {
+				t.Errorf("%s: want %v=%v, got %v=%v", c.name, c.want[i].Key(), c.want[i], kv.Key(), kv)
+			}
+		}
+	}
+}
+
+func TestServer_DecrementTTL(t *testing.T) {
+	now := time.Date(2020, 5, 31, 0, 0, 0, 0, time.UTC)
+	srv, err := NewServer(map[string]Zone{
+		"example.org.": {
+			A:   []string{"1.2.3.4"},
+			TTL: 60,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.Resolver().Now = func() time.Time { return now }
+	srv.DecrementTTL = true
+
+	ttl := func() uint32 {
+		t.Helper()
+		msg := new(dns.Msg)
+		msg.SetQuestion("example.org.", dns.TypeA)
+		reply, err := srv.Exchange(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(reply.Answer) != 1 {
+			t.Fatalf("Wrong amount of records in response: %v", reply.Answer)
+		}
+		return reply.Answer[0].Header().Ttl
+	}
+
+	// The first response starts the countdown.
+	start := now
+	steps := []struct {
+		elapsed time.Duration
+		ttl     uint32
+	}{
+		{0, 60},
+		{1500 * time.Millisecond, 59},
+		{45 * time.Second, 15},
+		{60 * time.Second, 0},
+		{61 * time.Second, 60},
+		{91 * time.Second, 30},
+	}
+	for _, step := range steps {
+		now = start.Add(step.elapsed)
+		if got := ttl(); got != step.ttl {
+			t.Errorf("After %v: want TTL %d, got %d", step.elapsed, step.ttl, got)
+		}
+	}
+
+	srv.CachedAt = start.Add(80 * time.Second)
+	now = start.Add(90 * time.Second)
+	if got := ttl(); got != 50 {
+		t.Errorf("Want TTL 50 with CachedAt, got %d", got)
+	}
+
+	srv.NoCache = true
+	if got := ttl(); got != 0 {
+		t.Errorf("NoCache is not applied: TTL %d", got)
+	}
+}
+
+func TestServer_AlwaysTruncate(t *testing.T) {
+	srv := NewUnstartedServer(map[string]Zone{
+		"example.org.": {
+			A:   []string{"1.2.3.4"},
+			TXT: []string{"hello"},
+		},
+	})
+	srv.AlwaysTruncate = true
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeTXT, dns.TypeMX} {
+		msg := new(dns.Msg)
+		msg.SetQuestion("example.org.", qtype)
+		msg.SetEdns0(4096, false)
+
+		cl := dns.Client{}
+		reply, _, err := cl.Exchange(msg, srv.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reply.Truncated || len(reply.Answer) != 0 || len(reply.Ns) != 0 {
+			t.Errorf("%s: UDP response is not truncated: %v", dns.TypeToString[qtype], reply)
+		}
+		if reply.IsEdns0() == nil {
+			t.Errorf("%s: no OPT record in truncated response", dns.TypeToString[qtype])
+		}
+
+		cl.Net = "tcp"
+		reply, _, err = cl.Exchange(msg, srv.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reply.Truncated || (qtype != dns.TypeMX && len(reply.Answer) != 1) {
+			t.Errorf("%s: wrong TCP response: %v", dns.TypeToString[qtype], reply)
+		}
+	}
+
+	var r net.Resolver
+	srv.PatchNet(&r)
+	addrs, err := r.LookupHost(context.Background(), "example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || addrs[0] != "1.2.3.4" {
+		t.Errorf("Wrong addresses: %v", addrs)
+	}
+}
+
+func TestServer_BinaryTXT(t *testing.T) {
+	values := []string{
+		"héllo wörld ✓",
+		"a\x00b\xff\\c\"d\\065",
+		// Multi-byte character across the character-string boundary.
+		strings.Repeat("a", 254) + "€" + strings.Repeat("b", 10),
+	}
+	zones := make(map[string]Zone)
+	for i, v := range values {
+		zones[fmt.Sprintf("t%d.example.org.", i)] = Zone{TXT: []string{v}}
+	}
+	srv, err := NewServer(zones)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	var r net.Resolver
+	srv.PatchNet(&r)
+
+	for i, want := range values {
+		name := fmt.Sprintf("t%d.example.org.", i)
+
+		for _, c := range []struct {
+			path   string
+			lookup func(ctx context.Context, name string) ([]string, error)
+		}{
+			{"Resolver", srv.Resolver().LookupTXT},
+			{"net.Resolver", r.LookupTXT},
+		} {
+			txt, err := c.lookup(context.Background(), name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(txt) != 1 || txt[0] != want {
+				t.Errorf("%s: %s: want %q, got %q", c.path, name, want, txt)
+			}
+		}
+
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeTXT)
+		cl := dns.Client{}
+		reply, _, err := cl.Exchange(msg, srv.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(reply.Answer) != 1 {
+			t.Fatal("Wrong amount of records in response:", reply.Answer)
+		}
+		var got string
+		for _, part := range reply.Answer[0].(*dns.TXT).Txt {
+			raw := unescapeTXT(part)
+			if len(raw) > 255 {
+				t.Errorf("%s: character-string is too long: %d bytes", name, len(raw))
+			}
+			got += raw
+		}
+		if got != want {
+			t.Errorf("wire: %s: want %q, got %q", name, want, got)
+		}
+	}
+}
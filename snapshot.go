@@ -0,0 +1,691 @@
+package mockdns
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// snapshotVersion is the version of the snapshot format written by
+// SaveSnapshot.
+const snapshotVersion = 1
+
+// snapshot is the JSON snapshot of Resolver or Server configuration.
+type snapshot struct {
+	Version  int              `json:"version"`
+	Resolver snapshotResolver `json:"resolver"`
+	Server   *snapshotServer  `json:"server,omitempty"`
+}
+
+type snapshotResolver struct {
+	Zones       map[string]snapshotZone     `json:"zones"`
+	Changes     map[string][]snapshotChange `json:"changes,omitempty"`
+	Default     *snapshotZone               `json:"default,omitempty"`
+	SkipCNAME   bool                        `json:"skip_cname,omitempty"`
+	Order       Order                       `json:"order,omitempty"`
+	Seed        int64                       `json:"seed,omitempty"`
+	Limit       int                         `json:"limit,omitempty"`
+	DNS64Prefix string                      `json:"dns64_prefix,omitempty"`
+	Timeout     duration                    `json:"timeout,omitempty"`
+	PortErr     *snapshotError              `json:"port_err,omitempty"`
+	WarmUp      bool                        `json:"warm_up,omitempty"`
+}
+
+type snapshotChange struct {
+	At   time.Time    `json:"at"`
+	Zone snapshotZone `json:"zone"`
+}
+
+type snapshotServer struct {
+	Compress       bool                    `json:"compress"`
+	UDPDelay       duration                `json:"udp_delay,omitempty"`
+	TCPDelay       duration                `json:"tcp_delay,omitempty"`
+	ExpireStart    time.Time               `json:"expire_start,omitempty"`
+	RequireCookie  bool                    `json:"require_cookie,omitempty"`
+	RefuseNoCookie bool                    `json:"refuse_no_cookie,omitempty"`
+	HijackNX       *snapshotZone           `json:"hijack_nx,omitempty"`
+	MinimizeANY    bool                    `json:"minimize_any,omitempty"`
+	ConditionalAD  bool                    `json:"conditional_ad,omitempty"`
+	EmitCNAMELoops bool                    `json:"emit_cname_loops,omitempty"`
+	Echo           bool                    `json:"echo,omitempty"`
+	NoCache        bool                    `json:"no_cache,omitempty"`
+	DecrementTTL   bool                    `json:"decrement_ttl,omitempty"`
+	CachedAt       time.Time               `json:"cached_at,omitempty"`
+	AlwaysTruncate bool                    `json:"always_truncate,omitempty"`
+	AnswerOnly     bool                    `json:"answer_only,omitempty"`
+	OmitQuestion   bool                    `json:"omit_question,omitempty"`
+	Views          []snapshotView          `json:"views,omitempty"`
+	TCPZones       map[string]snapshotZone `json:"tcp_zones,omitempty"`
+	QueryACL       snapshotACL             `json:"query_acl,omitempty"`
+	TransferACL    snapshotACL             `json:"transfer_acl,omitempty"`
+	MaxConcurrent  int                     `json:"max_concurrent,omitempty"`
+	Overload       Overload                `json:"overload,omitempty"`
+	QueueTimeout   duration                `json:"queue_timeout,omitempty"`
+}
+
+type snapshotView struct {
+	Nets  []string                `json:"nets"`
+	Zones map[string]snapshotZone `json:"zones"`
+}
+
+type snapshotACL struct {
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+}
+
+type snapshotZone struct {
+	Err        *snapshotError           `json:"err,omitempty"`
+	TTL        uint32                   `json:"ttl,omitempty"`
+	AD         bool                     `json:"ad,omitempty"`
+	A          []string                 `json:"a,omitempty"`
+	AAAA       []string                 `json:"aaaa,omitempty"`
+	TXT        [][]byte                 `json:"txt,omitempty"`
+	PTR        []string                 `json:"ptr,omitempty"`
+	CNAME      string                   `json:"cname,omitempty"`
+	MX         []net.MX                 `json:"mx,omitempty"`
+	NS         []net.NS                 `json:"ns,omitempty"`
+	SRV        []net.SRV                `json:"srv,omitempty"`
+	OPENPGPKEY []string                 `json:"openpgpkey,omitempty"`
+	SMIMEA     []TLSA                   `json:"smimea,omitempty"`
+	Misc       map[string][]string      `json:"misc,omitempty"`
+	EDE        *dns.EDNS0_EDE           `json:"ede,omitempty"`
+	Delegated  bool                     `json:"delegated,omitempty"`
+	Recursive  bool                     `json:"recursive,omitempty"`
+	NoGlue     bool                     `json:"no_glue,omitempty"`
+	Lame       bool                     `json:"lame,omitempty"`
+	Sticky     bool                     `json:"sticky,omitempty"`
+	TypeErr    map[string]snapshotError `json:"type_err,omitempty"`
+	FailAfter  int                      `json:"fail_after,omitempty"`
+	Delay      duration                 `json:"delay,omitempty"`
+	TypeDelay  map[string]duration      `json:"type_delay,omitempty"`
+}
+
+// snapshotError is the serialized error. *net.DNSError keeps its fields
+// except for the wrapped error, other errors keep only the text.
+type snapshotError struct {
+	DNSError *snapshotDNSError `json:"dns_error,omitempty"`
+	Text     string            `json:"text,omitempty"`
+}
+
+// snapshotDNSError is the serialized *net.DNSError. It lists the fields
+// explicitly, so the format does not depend on the Go version.
+type snapshotDNSError struct {
+	Err         string `json:"err"`
+	Name        string `json:"name,omitempty"`
+	Server      string `json:"server,omitempty"`
+	IsTimeout   bool   `json:"is_timeout,omitempty"`
+	IsTemporary bool   `json:"is_temporary,omitempty"`
+	IsNotFound  bool   `json:"is_not_found,omitempty"`
+}
+
+// duration is time.Duration serialized as string, e.g. "1.5s".
+type duration time.Duration
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(parsed)
+	return nil
+}
+
+// SaveSnapshot writes the configuration of the resolver to w as JSON: zones
+// with all their fields, scheduled changes and options. LoadSnapshot can
+// be used to restore it, e.g. in another process.
+//
+// Functions (Zone.Generate, Now) and the environment (Fallback, Rand) are
+// not saved. An error is returned if any zone uses Generate, as the
+// restored resolver would behave differently. Errors other than
+// *net.DNSError are saved as text and restored using errors.New. Errors
+// wrapped by *net.DNSError (UnwrapErr in Go 1.23+) are not saved.
+func (r *Resolver) SaveSnapshot(w io.Writer) error {
+	snap := snapshot{Version: snapshotVersion}
+	if err := r.saveSnapshot(&snap.Resolver); err != nil {
+		return err
+	}
+	return writeSnapshot(w, snap)
+}
+
+// LoadSnapshot replaces the configuration of the resolver saved using
+// SaveSnapshot with the one read from r. Fields that are not saved are not
+// modified. Counters (see ResetCounters) are reset.
+func (r *Resolver) LoadSnapshot(rd io.Reader) error {
+	snap, err := readSnapshot(rd)
+	if err != nil {
+		return err
+	}
+	return r.loadSnapshot(snap.Resolver)
+}
+
+// SaveSnapshot is the same as Resolver.SaveSnapshot, but also saves the
+// server options. In addition to the things not saved by Resolver, Log,
+// Rewrite and RawBytes are not saved. An error is returned if Rewrite or
+// RawBytes is set.
+func (s *Server) SaveSnapshot(w io.Writer) error {
+	if s.Rewrite != nil || s.RawBytes != nil {
+		return errors.New("mockdns: snapshot cannot include Rewrite or RawBytes")
+	}
+
+	snap := snapshot{Version: snapshotVersion}
+	if err := s.r.saveSnapshot(&snap.Resolver); err != nil {
+		return err
+	}
+
+	hijackNX, err := snapshotZonePtr(s.HijackNX)
+	if err != nil {
+		return err
+	}
+	tcpZones, err := snapshotZones(s.TCPZones)
+	if err != nil {
+		return err
+	}
+	srv := &snapshotServer{
+		Compress:       s.Compress,
+		UDPDelay:       duration(s.UDPDelay),
+		TCPDelay:       duration(s.TCPDelay),
+		ExpireStart:    s.ExpireStart,
+		RequireCookie:  s.RequireCookie,
+		RefuseNoCookie: s.RefuseNoCookie,
+		HijackNX:       hijackNX,
+		MinimizeANY:    s.MinimizeANY,
+		ConditionalAD:  s.ConditionalAD,
+		EmitCNAMELoops: s.EmitCNAMELoops,
+		Echo:           s.Echo,
+		NoCache:        s.NoCache,
+		DecrementTTL:   s.DecrementTTL,
+		CachedAt:       s.CachedAt,
+		AlwaysTruncate: s.AlwaysTruncate,
+		AnswerOnly:     s.AnswerOnly,
+		OmitQuestion:   s.OmitQuestion,
+		TCPZones:       tcpZones,
+		QueryACL:       snapshotACLOf(s.QueryACL),
+		TransferACL:    snapshotACLOf(s.TransferACL),
+		MaxConcurrent:  s.MaxConcurrent,
+		Overload:       s.Overload,
+		QueueTimeout:   duration(s.QueueTimeout),
+	}
+	for _, v := range s.Views {
+		zones, err := snapshotZones(v.Zones)
+		if err != nil {
+			return err
+		}
+		srv.Views = append(srv.Views, snapshotView{Nets: netStrings(v.Nets), Zones: zones})
+	}
+	snap.Server = srv
+
+	return writeSnapshot(w, snap)
+}
+
+// LoadSnapshot is the same as Resolver.LoadSnapshot, but also restores the
+// server options. If the snapshot was saved using Resolver.SaveSnapshot,
+// server options are not modified.
+func (s *Server) LoadSnapshot(rd io.Reader) error {
+	snap, err := readSnapshot(rd)
+	if err != nil {
+		return err
+	}
+	if err := s.r.loadSnapshot(snap.Resolver); err != nil {
+		return err
+	}
+	srv := snap.Server
+	if srv == nil {
+		return nil
+	}
+
+	hijackNX, err := srv.HijackNX.zonePtr()
+	if err != nil {
+		return err
+	}
+	tcpZones, err := zonesOf(srv.TCPZones)
+	if err != nil {
+		return err
+	}
+	queryACL, err := srv.QueryACL.acl()
+	if err != nil {
+		return err
+	}
+	transferACL, err := srv.TransferACL.acl()
+	if err != nil {
+		return err
+	}
+	var views []View
+	for _, v := range srv.Views {
+		nets, err := parseNets(v.Nets)
+		if err != nil {
+			return err
+		}
+		zones, err := zonesOf(v.Zones)
+		if err != nil {
+			return err
+		}
+		views = append(views, View{Nets: nets, Zones: zones})
+	}
+
+	s.Compress = srv.Compress
+	s.UDPDelay = time.Duration(srv.UDPDelay)
+	s.TCPDelay = time.Duration(srv.TCPDelay)
+	s.ExpireStart = srv.ExpireStart
+	s.RequireCookie = srv.RequireCookie
+	s.RefuseNoCookie = srv.RefuseNoCookie
+	s.HijackNX = hijackNX
+	s.MinimizeANY = srv.MinimizeANY
+	s.ConditionalAD = srv.ConditionalAD
+	s.EmitCNAMELoops = srv.EmitCNAMELoops
+	s.Echo = srv.Echo
+	s.NoCache = srv.NoCache
+	s.DecrementTTL = srv.DecrementTTL
+	s.CachedAt = srv.CachedAt
+	s.AlwaysTruncate = srv.AlwaysTruncate
+	s.AnswerOnly = srv.AnswerOnly
+	s.OmitQuestion = srv.OmitQuestion
+	s.Views = views
+	s.TCPZones = tcpZones
+	s.QueryACL = queryACL
+	s.TransferACL = transferACL
+	s.MaxConcurrent = srv.MaxConcurrent
+	s.Overload = srv.Overload
+	s.QueueTimeout = time.Duration(srv.QueueTimeout)
+	return nil
+}
+
+func writeSnapshot(w io.Writer, snap snapshot) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	return enc.Encode(snap)
+}
+
+func readSnapshot(r io.Reader) (snapshot, error) {
+	var snap snapshot
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&snap); err != nil {
+		return snapshot{}, fmt.Errorf("mockdns: malformed snapshot: %w", err)
+	}
+	if snap.Version != snapshotVersion {
+		return snapshot{}, fmt.Errorf("mockdns: unsupported snapshot version: %d", snap.Version)
+	}
+	return snap, nil
+}
+
+func (r *Resolver) saveSnapshot(snap *snapshotResolver) error {
+	zones, err := snapshotZones(r.Zones)
+	if err != nil {
+		return err
+	}
+	def, err := snapshotZonePtr(r.Default)
+	if err != nil {
+		return err
+	}
+
+	*snap = snapshotResolver{
+		Zones:     zones,
+		Default:   def,
+		SkipCNAME: r.SkipCNAME,
+		Order:     r.Order,
+		Seed:      r.Seed,
+		Limit:     r.Limit,
+		Timeout:   duration(r.Timeout),
+		PortErr:   snapshotErrorOf(r.PortErr),
+		WarmUp:    r.WarmUp,
+	}
+	if r.DNS64Prefix != nil {
+		snap.DNS64Prefix = r.DNS64Prefix.String()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for name, changes := range r.changes {
+		for _, c := range changes {
+			z, err := snapshotZoneOf(c.zone)
+			if err != nil {
+				return err
+			}
+			if snap.Changes == nil {
+				snap.Changes = make(map[string][]snapshotChange)
+			}
+			snap.Changes[name] = append(snap.Changes[name], snapshotChange{At: c.at, Zone: z})
+		}
+	}
+	return nil
+}
+
+func (r *Resolver) loadSnapshot(snap snapshotResolver) error {
+	zones, err := zonesOf(snap.Zones)
+	if err != nil {
+		return err
+	}
+	def, err := snap.Default.zonePtr()
+	if err != nil {
+		return err
+	}
+	var prefix *net.IPNet
+	if snap.DNS64Prefix != "" {
+		if _, prefix, err = net.ParseCIDR(snap.DNS64Prefix); err != nil {
+			return err
+		}
+	}
+	changes := make(map[string][]scheduledChange, len(snap.Changes))
+	for name, snapChanges := range snap.Changes {
+		for _, c := range snapChanges {
+			z, err := c.Zone.zone()
+			if err != nil {
+				return err
+			}
+			changes[name] = append(changes[name], scheduledChange{at: c.At, zone: z})
+		}
+	}
+
+	r.Zones = zones
+	r.Default = def
+	r.SkipCNAME = snap.SkipCNAME
+	r.Order = snap.Order
+	r.Seed = snap.Seed
+	r.Limit = snap.Limit
+	r.DNS64Prefix = prefix
+	r.Timeout = time.Duration(snap.Timeout)
+	r.PortErr = snap.PortErr.err()
+	r.WarmUp = snap.WarmUp
+
+	r.ResetCounters()
+	r.mu.Lock()
+	r.changes = changes
+	r.mu.Unlock()
+	return nil
+}
+
+func snapshotZones(zones map[string]Zone) (map[string]snapshotZone, error) {
+	if zones == nil {
+		return nil, nil
+	}
+	snap := make(map[string]snapshotZone, len(zones))
+	for name, z := range zones {
+		sz, err := snapshotZoneOf(z)
+		if err != nil {
+			return nil, fmt.Errorf("mockdns: zone %s: %w", name, err)
+		}
+		snap[name] = sz
+	}
+	return snap, nil
+}
+
+func zonesOf(snap map[string]snapshotZone) (map[string]Zone, error) {
+	if snap == nil {
+		return nil, nil
+	}
+	zones := make(map[string]Zone, len(snap))
+	for name, sz := range snap {
+		z, err := sz.zone()
+		if err != nil {
+			return nil, fmt.Errorf("mockdns: zone %s: %w", name, err)
+		}
+		zones[name] = z
+	}
+	return zones, nil
+}
+
+func snapshotZonePtr(z *Zone) (*snapshotZone, error) {
+	if z == nil {
+		return nil, nil
+	}
+	sz, err := snapshotZoneOf(*z)
+	if err != nil {
+		return nil, err
+	}
+	return &sz, nil
+}
+
+func (sz *snapshotZone) zonePtr() (*Zone, error) {
+	if sz == nil {
+		return nil, nil
+	}
+	z, err := sz.zone()
+	if err != nil {
+		return nil, err
+	}
+	return &z, nil
+}
+
+func snapshotZoneOf(z Zone) (snapshotZone, error) {
+	if z.Generate != nil {
+		return snapshotZone{}, errors.New("Generate cannot be saved")
+	}
+
+	sz := snapshotZone{
+		Err:        snapshotErrorOf(z.Err),
+		TTL:        z.TTL,
+		AD:         z.AD,
+		A:          z.A,
+		AAAA:       z.AAAA,
+		TXT:        txtBytes(z.TXT),
+		PTR:        z.PTR,
+		CNAME:      z.CNAME,
+		MX:         z.MX,
+		NS:         z.NS,
+		SRV:        z.SRV,
+		OPENPGPKEY: z.OPENPGPKEY,
+		SMIMEA:     z.SMIMEA,
+		EDE:        z.EDE,
+		Delegated:  z.Delegated,
+		Recursive:  z.Recursive,
+		NoGlue:     z.NoGlue,
+		Lame:       z.Lame,
+		Sticky:     z.Sticky,
+		FailAfter:  z.FailAfter,
+		Delay:      duration(z.Delay),
+	}
+	for t, rrs := range z.Misc {
+		if sz.Misc == nil {
+			sz.Misc = make(map[string][]string, len(z.Misc))
+		}
+		strs := make([]string, 0, len(rrs))
+		for _, rr := range rrs {
+			strs = append(strs, rr.String())
+		}
+		sz.Misc[t.String()] = strs
+	}
+	for t, err := range z.TypeErr {
+		if sz.TypeErr == nil {
+			sz.TypeErr = make(map[string]snapshotError, len(z.TypeErr))
+		}
+		sz.TypeErr[t.String()] = *snapshotErrorOf(err)
+	}
+	for t, d := range z.TypeDelay {
+		if sz.TypeDelay == nil {
+			sz.TypeDelay = make(map[string]duration, len(z.TypeDelay))
+		}
+		sz.TypeDelay[t.String()] = duration(d)
+	}
+	return sz, nil
+}
+
+func (sz snapshotZone) zone() (Zone, error) {
+	z := Zone{
+		Err:        sz.Err.err(),
+		TTL:        sz.TTL,
+		AD:         sz.AD,
+		A:          sz.A,
+		AAAA:       sz.AAAA,
+		TXT:        txtStrings(sz.TXT),
+		PTR:        sz.PTR,
+		CNAME:      sz.CNAME,
+		MX:         sz.MX,
+		NS:         sz.NS,
+		SRV:        sz.SRV,
+		OPENPGPKEY: sz.OPENPGPKEY,
+		SMIMEA:     sz.SMIMEA,
+		EDE:        sz.EDE,
+		Delegated:  sz.Delegated,
+		Recursive:  sz.Recursive,
+		NoGlue:     sz.NoGlue,
+		Lame:       sz.Lame,
+		Sticky:     sz.Sticky,
+		FailAfter:  sz.FailAfter,
+		Delay:      time.Duration(sz.Delay),
+	}
+	for name, strs := range sz.Misc {
+		t, err := parseType(name)
+		if err != nil {
+			return Zone{}, err
+		}
+		if z.Misc == nil {
+			z.Misc = make(map[dns.Type][]dns.RR, len(sz.Misc))
+		}
+		for _, s := range strs {
+			rr, err := dns.NewRR(s)
+			if err != nil {
+				return Zone{}, err
+			}
+			z.Misc[t] = append(z.Misc[t], rr)
+		}
+	}
+	for name, snapErr := range sz.TypeErr {
+		t, err := parseType(name)
+		if err != nil {
+			return Zone{}, err
+		}
+		if z.TypeErr == nil {
+			z.TypeErr = make(map[dns.Type]error, len(sz.TypeErr))
+		}
+		z.TypeErr[t] = snapErr.err()
+	}
+	for name, d := range sz.TypeDelay {
+		t, err := parseType(name)
+		if err != nil {
+			return Zone{}, err
+		}
+		if z.TypeDelay == nil {
+			z.TypeDelay = make(map[dns.Type]time.Duration, len(sz.TypeDelay))
+		}
+		z.TypeDelay[t] = time.Duration(d)
+	}
+	return z, nil
+}
+
+// txtBytes converts TXT values to []byte, which is saved as base64, so
+// values that are not valid UTF-8 are preserved.
+func txtBytes(txt []string) [][]byte {
+	if txt == nil {
+		return nil
+	}
+	b := make([][]byte, 0, len(txt))
+	for _, s := range txt {
+		b = append(b, []byte(s))
+	}
+	return b
+}
+
+func txtStrings(b [][]byte) []string {
+	if b == nil {
+		return nil
+	}
+	txt := make([]string, 0, len(b))
+	for _, s := range b {
+		txt = append(txt, string(s))
+	}
+	return txt
+}
+
+// parseType parses the record type in the format of dns.Type.String.
+func parseType(s string) (dns.Type, error) {
+	if t, ok := dns.StringToType[s]; ok {
+		return dns.Type(t), nil
+	}
+	if strings.HasPrefix(s, "TYPE") {
+		if t, err := strconv.ParseUint(s[len("TYPE"):], 10, 16); err == nil {
+			return dns.Type(t), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown record type: %s", s)
+}
+
+func snapshotErrorOf(err error) *snapshotError {
+	if err == nil {
+		return nil
+	}
+	if dnsErr, ok := err.(*net.DNSError); ok {
+		return &snapshotError{DNSError: &snapshotDNSError{
+			Err:         dnsErr.Err,
+			Name:        dnsErr.Name,
+			Server:      dnsErr.Server,
+			IsTimeout:   dnsErr.IsTimeout,
+			IsTemporary: dnsErr.IsTemporary,
+			IsNotFound:  dnsErr.IsNotFound,
+		}}
+	}
+	return &snapshotError{Text: err.Error()}
+}
+
+func (se *snapshotError) err() error {
+	if se == nil {
+		return nil
+	}
+	if e := se.DNSError; e != nil {
+		return &net.DNSError{
+			Err:         e.Err,
+			Name:        e.Name,
+			Server:      e.Server,
+			IsTimeout:   e.IsTimeout,
+			IsTemporary: e.IsTemporary,
+			IsNotFound:  e.IsNotFound,
+		}
+	}
+	return errors.New(se.Text)
+}
+
+func snapshotACLOf(acl ACL) snapshotACL {
+	return snapshotACL{Allow: netStrings(acl.Allow), Deny: netStrings(acl.Deny)}
+}
+
+func (sa snapshotACL) acl() (ACL, error) {
+	allow, err := parseNets(sa.Allow)
+	if err != nil {
+		return ACL{}, err
+	}
+	deny, err := parseNets(sa.Deny)
+	if err != nil {
+		return ACL{}, err
+	}
+	return ACL{Allow: allow, Deny: deny}, nil
+}
+
+func netStrings(nets []*net.IPNet) []string {
+	if nets == nil {
+		return nil
+	}
+	strs := make([]string, 0, len(nets))
+	for _, n := range nets {
+		strs = append(strs, n.String())
+	}
+	return strs
+}
+
+func parseNets(strs []string) ([]*net.IPNet, error) {
+	if strs == nil {
+		return nil, nil
+	}
+	nets := make([]*net.IPNet, 0, len(strs))
+	for _, s := range strs {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
@@ -0,0 +1,165 @@
+package mockdns
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func snapshotTestZones(t *testing.T) map[string]Zone {
+	t.Helper()
+	caa, err := dns.NewRR(`example.org. 300 IN CAA 0 issue "ca.example.net"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]Zone{
+		"example.org.": {
+			TTL:  300,
+			AD:   true,
+			A:    []string{"1.2.3.4"},
+			AAAA: []string{"::1"},
+			TXT:  []string{"v=spf1 -all", "a\x00\xff\xfeb"},
+			MX:   []net.MX{{Host: "mx.example.org.", Pref: 10}},
+			NS:   []net.NS{{Host: "ns.example.org."}},
+			Misc: map[dns.Type][]dns.RR{
+				dns.Type(dns.TypeCAA): {caa},
+			},
+			EDE:       &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeStaleAnswer, ExtraText: "stale"},
+			TypeErr:   map[dns.Type]error{dns.Type(dns.TypeSRV): errors.New("srv broken")},
+			TypeDelay: map[dns.Type]time.Duration{dns.Type(dns.TypeTXT): 10 * time.Millisecond},
+			Sticky:    true,
+		},
+		"_sip._tcp.example.org.": {
+			SRV: []net.SRV{{Target: "sip.example.org.", Port: 5060, Priority: 1, Weight: 2}},
+		},
+		"nx.example.org.": {
+			Err: &net.DNSError{Err: "no such host", Name: "nx.example.org", IsNotFound: true},
+		},
+		"sub.example.org.": {
+			Delegated: true,
+			Lame:      true,
+			NS:        []net.NS{{Host: "ns.sub.example.org."}},
+			Delay:     time.Second,
+		},
+	}
+}
+
+func TestServer_Snapshot(t *testing.T) {
+	srv := NewUnstartedServer(snapshotTestZones(t))
+	srv.Resolver().Order = OrderRoundRobin
+	srv.Resolver().Limit = 2
+	srv.Resolver().Default = &Zone{A: []string{"10.0.0.1"}}
+	srv.Resolver().PortErr = errors.New("no ports")
+	srv.Resolver().ScheduleChange("example.org.", time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC), Zone{A: []string{"5.6.7.8"}})
+	_, local, _ := net.ParseCIDR("127.0.0.0/8")
+	srv.NoCache = true
+	srv.CachedAt = time.Date(2020, 5, 31, 0, 0, 0, 0, time.UTC)
+	srv.UDPDelay = 5 * time.Millisecond
+	srv.QueryACL = ACL{Allow: []*net.IPNet{local}}
+	srv.Views = []View{{Nets: []*net.IPNet{local}, Zones: map[string]Zone{
+		"example.org.": {A: []string{"192.0.2.1"}},
+	}}}
+	srv.TCPZones = map[string]Zone{"example.org.": {A: []string{"192.0.2.2"}}}
+	srv.MaxConcurrent = 4
+	srv.Overload = OverloadRefuse
+
+	var saved bytes.Buffer
+	if err := srv.SaveSnapshot(&saved); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := NewUnstartedServer(nil)
+	if err := loaded.LoadSnapshot(bytes.NewReader(saved.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(loaded.Resolver().Zones, srv.Resolver().Zones) {
+		t.Errorf("Zones not preserved:\nwant %#v\ngot  %#v", srv.Resolver().Zones, loaded.Resolver().Zones)
+	}
+	if !reflect.DeepEqual(loaded.Views, srv.Views) {
+		t.Errorf("Views not preserved:\nwant %#v\ngot  %#v", srv.Views, loaded.Views)
+	}
+	if !reflect.DeepEqual(loaded.QueryACL, srv.QueryACL) {
+		t.Errorf("QueryACL not preserved:\nwant %#v\ngot  %#v", srv.QueryACL, loaded.QueryACL)
+	}
+
+	var resaved bytes.Buffer
+	if err := loaded.SaveSnapshot(&resaved); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(resaved.Bytes(), saved.Bytes()) {
+		t.Errorf("Snapshot changed after round-trip:\nwant %s\ngot  %s", saved.Bytes(), resaved.Bytes())
+	}
+
+	// The restored server should serve the same responses.
+	loaded.Views = nil
+	if err := loaded.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer loaded.Close()
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.org.", dns.TypeA)
+	reply, err := loaded.Exchange(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.Answer) != 1 || reply.Answer[0].Header().Ttl != 0 || !reply.AuthenticatedData {
+		t.Errorf("Wrong response from restored server: %v", reply)
+	}
+}
+
+func TestResolver_Snapshot(t *testing.T) {
+	r := Resolver{Zones: snapshotTestZones(t), SkipCNAME: true, Timeout: time.Second}
+	var saved bytes.Buffer
+	if err := r.SaveSnapshot(&saved); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := NewUnstartedServer(nil)
+	srv.Compress = true
+	if err := srv.LoadSnapshot(&saved); err != nil {
+		t.Fatal(err)
+	}
+	if !srv.Compress {
+		t.Error("Server options modified by resolver snapshot")
+	}
+	restored := srv.Resolver()
+	if !reflect.DeepEqual(restored.Zones, r.Zones) || !restored.SkipCNAME || restored.Timeout != time.Second {
+		t.Errorf("Resolver not preserved: %#v", restored)
+	}
+
+	txt, err := restored.LookupTXT(context.Background(), "example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(txt, []string{"v=spf1 -all", "a\x00\xff\xfeb"}) {
+		t.Errorf("Binary TXT not preserved: %q", txt)
+	}
+
+	_, err = restored.LookupHost(context.Background(), "nx.example.org")
+	if dnsErr, ok := err.(*net.DNSError); !ok || !dnsErr.IsNotFound {
+		t.Errorf("Wrong error for nx.example.org: %v", err)
+	}
+}
+
+func TestResolver_Snapshot_Unsupported(t *testing.T) {
+	r := Resolver{Zones: map[string]Zone{
+		"example.org.": {Generate: func(dns.Question) Zone { return Zone{} }},
+	}}
+	if err := r.SaveSnapshot(new(bytes.Buffer)); err == nil {
+		t.Error("Expected error for Generate")
+	}
+
+	if err := r.LoadSnapshot(bytes.NewReader([]byte(`{"version": 2, "resolver": {}}`))); err == nil {
+		t.Error("Expected error for unknown version")
+	}
+	if r.Zones["example.org."].Generate == nil {
+		t.Error("Failed load modified the resolver")
+	}
+}
@@ -0,0 +1,44 @@
+//+build go1.23
+
+package mockdns
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestResolver_Snapshot_WrappedDNSError(t *testing.T) {
+	r := Resolver{Zones: map[string]Zone{
+		"example.org.": {
+			Err: &net.DNSError{
+				Err:       "i/o timeout",
+				Name:      "example.org",
+				IsTimeout: true,
+				UnwrapErr: context.DeadlineExceeded,
+			},
+		},
+	}}
+
+	var saved bytes.Buffer
+	if err := r.SaveSnapshot(&saved); err != nil {
+		t.Fatal(err)
+	}
+	var loaded Resolver
+	if err := loaded.LoadSnapshot(&saved); err != nil {
+		t.Fatal(err)
+	}
+
+	var dnsErr *net.DNSError
+	if !errors.As(loaded.Zones["example.org."].Err, &dnsErr) {
+		t.Fatalf("Wrong error type: %T", loaded.Zones["example.org."].Err)
+	}
+	if dnsErr.Err != "i/o timeout" || dnsErr.Name != "example.org" || !dnsErr.IsTimeout || dnsErr.IsTemporary {
+		t.Errorf("DNSError not preserved: %#v", dnsErr)
+	}
+	if dnsErr.UnwrapErr != nil {
+		t.Errorf("Wrapped error is restored: %v", dnsErr.UnwrapErr)
+	}
+}
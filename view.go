@@ -0,0 +1,44 @@
+package mockdns
+
+import (
+	"context"
+	"net"
+)
+
+// View is the set of zones served by Server to clients from the specific
+// networks, allowing to simulate split-horizon DNS.
+type View struct {
+	// Nets are the networks of the clients that get this view.
+	Nets []*net.IPNet
+
+	// Zones are used instead of Resolver.Zones for clients of this view.
+	// Other Resolver settings still apply.
+	Zones map[string]Zone
+}
+
+// contains reports whether the client IP belongs to the view.
+func (v View) contains(client net.IP) bool {
+	for _, n := range v.Nets {
+		if n.Contains(client) {
+			return true
+		}
+	}
+	return false
+}
+
+// viewContext returns the context for answering the query q, carrying
+// TCPZones or the zones of the view matching the client, if any.
+func (s *Server) viewContext(q query) context.Context {
+	if q.tcp && s.TCPZones != nil {
+		return context.WithValue(s.ctx, viewZonesKey{}, s.TCPZones)
+	}
+	if q.client == nil {
+		return s.ctx
+	}
+	for _, v := range s.Views {
+		if v.contains(q.client) {
+			return context.WithValue(s.ctx, viewZonesKey{}, v.Zones)
+		}
+	}
+	return s.ctx
+}
@@ -0,0 +1,119 @@
+package mockdns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestServer_Views(t *testing.T) {
+	srv, err := NewServer(map[string]Zone{
+		"app.example.org.": {
+			A:   []string{"203.0.113.10"},
+			TTL: 3600,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	_, internal, _ := net.ParseCIDR("10.0.0.0/8")
+	srv.Views = []View{
+		{
+			Nets: []*net.IPNet{internal},
+			Zones: map[string]Zone{
+				"app.example.org.": {
+					A:   []string{"10.0.0.10"},
+					TTL: 30,
+				},
+				"db.example.org.": {
+					A: []string{"10.0.0.20"},
+				},
+			},
+		},
+	}
+
+	query := func(client, name string) *dns.Msg {
+		t.Helper()
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeA)
+		reply, err := srv.exchange(&memWriter{
+			local:  srv.LocalAddr(),
+			remote: &net.UDPAddr{IP: net.ParseIP(client), Port: 53000},
+		}, msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return reply
+	}
+
+	cases := []struct {
+		client string
+		addr   string
+		ttl    uint32
+	}{
+		{"10.1.2.3", "10.0.0.10", 30},
+		{"198.51.100.1", "203.0.113.10", 3600},
+	}
+	for _, c := range cases {
+		reply := query(c.client, "app.example.org.")
+		if len(reply.Answer) != 1 {
+			t.Fatalf("%s: wrong amount of records in response: %v", c.client, reply.Answer)
+		}
+		a := reply.Answer[0].(*dns.A)
+		if a.A.String() != c.addr || a.Hdr.Ttl != c.ttl {
+			t.Errorf("%s: want %s with TTL %d, got %v", c.client, c.addr, c.ttl, a)
+		}
+	}
+
+	// Names only present in the internal view.
+	if reply := query("10.1.2.3", "db.example.org."); len(reply.Answer) != 1 {
+		t.Errorf("Internal name is not resolved for internal client: %v", reply)
+	}
+	if reply := query("198.51.100.1", "db.example.org."); reply.Rcode != dns.RcodeNameError {
+		t.Errorf("Internal name is resolved for external client: %v", reply)
+	}
+}
+
+func TestServer_TCPZones(t *testing.T) {
+	srv, err := NewServer(map[string]Zone{
+		"a.example.org.": {CNAME: "b.example.org."},
+		"b.example.org.": {A: []string{"192.0.2.1"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	srv.TCPZones = map[string]Zone{
+		"a.example.org.": {CNAME: "b.example.org."},
+		"b.example.org.": {A: []string{"192.0.2.2"}},
+	}
+
+	for _, c := range []struct {
+		net  string
+		addr string
+	}{
+		{"udp", "192.0.2.1"},
+		{"tcp", "192.0.2.2"},
+	} {
+		msg := new(dns.Msg)
+		msg.SetQuestion("a.example.org.", dns.TypeA)
+		cl := dns.Client{Net: c.net}
+		reply, _, err := cl.Exchange(msg, srv.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(reply.Answer) != 2 {
+			t.Fatalf("%s: wrong amount of records in response: %v", c.net, reply.Answer)
+		}
+		if cname := reply.Answer[0].(*dns.CNAME); cname.Target != "b.example.org." {
+			t.Errorf("%s: wrong CNAME: %v", c.net, cname)
+		}
+		if a := reply.Answer[1].(*dns.A); a.A.String() != c.addr {
+			t.Errorf("%s: want %s, got %v", c.net, c.addr, a)
+		}
+	}
+}
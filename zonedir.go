@@ -0,0 +1,65 @@
+//+build go1.16
+
+package mockdns
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// LoadZoneDir reads all *.zone files in the directory dir of fsys using
+// ParseZone and merges them into one zones map.
+//
+// The initial $ORIGIN for each file is its name without the .zone
+// extension (e.g. example.org.zone has example.org. origin). It is an error
+// for multiple files to contain records with the same owner name and
+// type.
+func LoadZoneDir(fsys fs.FS, dir string) (map[string]Zone, error) {
+	files, err := fs.Glob(fsys, path.Join(dir, "*.zone"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	type ownerType struct {
+		name  string
+		rtype uint16
+	}
+	defined := make(map[ownerType]string)
+
+	zones := make(map[string]Zone)
+	for _, file := range files {
+		f, err := fsys.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		origin := strings.TrimSuffix(path.Base(file), ".zone")
+		fileZones, err := ParseZone(f, origin, file)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for name, z := range fileZones {
+			for _, rr := range zoneRRs(name, z) {
+				key := ownerType{name, rr.Header().Rrtype}
+				if prev, ok := defined[key]; ok && prev != file {
+					return nil, fmt.Errorf("%s: %s %s records are already defined in %s",
+						file, name, dns.TypeToString[key.rtype], prev)
+				}
+				defined[key] = file
+
+				if err := addRR(zones, rr); err != nil {
+					return nil, fmt.Errorf("%s: %v", file, err)
+				}
+			}
+		}
+	}
+
+	return zones, nil
+}
@@ -0,0 +1,51 @@
+//+build go1.16
+
+package mockdns
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestLoadZoneDir(t *testing.T) {
+	fsys := fstest.MapFS{
+		"zones/example.org.zone": {Data: []byte(testZoneFile)},
+		"zones/example.net.zone": {Data: []byte("@ IN A 192.0.2.3\nwww IN A 192.0.2.4\n")},
+		"zones/README":           {Data: []byte("not a zone")},
+	}
+
+	zones, err := LoadZoneDir(fsys, "zones")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"192.0.2.3"}; !reflect.DeepEqual(zones["example.net."].A, want) {
+		t.Errorf("Wrong A records, want %v, got %v", want, zones["example.net."].A)
+	}
+	if want := []string{"192.0.2.2", "192.0.2.1"}; !reflect.DeepEqual(zones["example.org."].A, want) {
+		t.Errorf("Wrong A records, want %v, got %v", want, zones["example.org."].A)
+	}
+
+	fsys["zones/conflict.zone"] = &fstest.MapFile{Data: []byte("www.example.net. IN A 192.0.2.5\n")}
+	_, err = LoadZoneDir(fsys, "zones")
+	if err == nil || !strings.Contains(err.Error(), "conflict.zone") {
+		t.Errorf("Expected conflict error, got %v", err)
+	}
+
+	fsys["zones/conflict.zone"] = &fstest.MapFile{Data: []byte("www.example.net. IN TXT hello\n")}
+	zones, err = LoadZoneDir(fsys, "zones")
+	if err != nil {
+		t.Fatal(err)
+	}
+	www := zones["www.example.net."]
+	if len(www.A) != 1 || len(www.TXT) != 1 {
+		t.Errorf("Records from different files are not merged: %+v", www)
+	}
+
+	fsys["zones/broken.zone"] = &fstest.MapFile{Data: []byte("@ IN A 1.2.3\n")}
+	_, err = LoadZoneDir(fsys, "zones")
+	if err == nil || !strings.Contains(err.Error(), "broken.zone") {
+		t.Errorf("Expected parse error mentioning file name, got %v", err)
+	}
+}
@@ -0,0 +1,141 @@
+package mockdns
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// ParseZone reads the zone in the master file format (RFC 1035) from r and
+// converts it into the zones map usable with Resolver and Server.
+//
+// origin is used as the initial $ORIGIN and file is used in error messages
+// and for $INCLUDE. Records are kept in the order they appear in the file.
+func ParseZone(r io.Reader, origin, file string) (map[string]Zone, error) {
+	zones := make(map[string]Zone)
+
+	zp := dns.NewZoneParser(r, dns.Fqdn(origin), file)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		if err := addRR(zones, rr); err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+
+	return zones, nil
+}
+
+// addRR adds the record to the zones map, converting it into the
+// corresponding Zone field.
+func addRR(zones map[string]Zone, rr dns.RR) error {
+	hdr := rr.Header()
+	name := strings.ToLower(hdr.Name)
+	z := zones[name]
+
+	switch rr := rr.(type) {
+	case *dns.A:
+		z.A = append(z.A, rr.A.String())
+	case *dns.AAAA:
+		z.AAAA = append(z.AAAA, rr.AAAA.String())
+	case *dns.TXT:
+		var txt strings.Builder
+		for _, part := range rr.Txt {
+			txt.WriteString(unescapeTXT(part))
+		}
+		z.TXT = append(z.TXT, txt.String())
+	case *dns.PTR:
+		z.PTR = append(z.PTR, rr.Ptr)
+	case *dns.CNAME:
+		if z.CNAME != "" {
+			return fmt.Errorf("multiple CNAME records for %s", name)
+		}
+		z.CNAME = rr.Target
+	case *dns.MX:
+		z.MX = append(z.MX, net.MX{Host: rr.Mx, Pref: rr.Preference})
+	case *dns.NS:
+		z.NS = append(z.NS, net.NS{Host: rr.Ns})
+	case *dns.SRV:
+		z.SRV = append(z.SRV, net.SRV{
+			Target:   rr.Target,
+			Port:     rr.Port,
+			Priority: rr.Priority,
+			Weight:   rr.Weight,
+		})
+	case *dns.OPENPGPKEY:
+		z.OPENPGPKEY = append(z.OPENPGPKEY, rr.PublicKey)
+	case *dns.SMIMEA:
+		z.SMIMEA = append(z.SMIMEA, TLSA{
+			Usage:        rr.Usage,
+			Selector:     rr.Selector,
+			MatchingType: rr.MatchingType,
+			Certificate:  rr.Certificate,
+		})
+	default:
+		if z.Misc == nil {
+			z.Misc = make(map[dns.Type][]dns.RR)
+		}
+		z.Misc[dns.Type(hdr.Rrtype)] = append(z.Misc[dns.Type(hdr.Rrtype)], rr)
+	}
+
+	zones[name] = z
+	return nil
+}
+
+// zoneRRs returns static records of the zone as RRs with the specified owner
+// name. Malformed addresses are skipped.
+func zoneRRs(name string, z Zone) []dns.RR {
+	var rrs []dns.RR
+	for _, addr := range z.A {
+		if ip := parseAddr(dns.TypeA, addr); ip != nil {
+			rrs = append(rrs, &dns.A{Hdr: z.hdr(name, dns.TypeA), A: ip})
+		}
+	}
+	for _, addr := range z.AAAA {
+		if ip := parseAddr(dns.TypeAAAA, addr); ip != nil {
+			rrs = append(rrs, &dns.AAAA{Hdr: z.hdr(name, dns.TypeAAAA), AAAA: ip})
+		}
+	}
+	for _, txt := range z.TXT {
+		rrs = append(rrs, &dns.TXT{Hdr: z.hdr(name, dns.TypeTXT), Txt: splitTXT(txt)})
+	}
+	for _, ptr := range z.PTR {
+		rrs = append(rrs, &dns.PTR{Hdr: z.hdr(name, dns.TypePTR), Ptr: ptr})
+	}
+	if z.CNAME != "" {
+		rrs = append(rrs, &dns.CNAME{Hdr: z.hdr(name, dns.TypeCNAME), Target: z.CNAME})
+	}
+	for _, mx := range z.MX {
+		rrs = append(rrs, &dns.MX{Hdr: z.hdr(name, dns.TypeMX), Preference: mx.Pref, Mx: mx.Host})
+	}
+	for _, ns := range z.NS {
+		rrs = append(rrs, &dns.NS{Hdr: z.hdr(name, dns.TypeNS), Ns: ns.Host})
+	}
+	for _, srv := range z.SRV {
+		rrs = append(rrs, &dns.SRV{
+			Hdr:      z.hdr(name, dns.TypeSRV),
+			Priority: srv.Priority,
+			Weight:   srv.Weight,
+			Port:     srv.Port,
+			Target:   srv.Target,
+		})
+	}
+	rrs = append(rrs, openpgpkeyRRs(name, z)...)
+	rrs = append(rrs, smimeaRRs(name, z)...)
+
+	types := make([]int, 0, len(z.Misc))
+	for t := range z.Misc {
+		types = append(types, int(t))
+	}
+	sort.Ints(types)
+	for _, t := range types {
+		rrs = append(rrs, z.Misc[dns.Type(t)]...)
+	}
+
+	return rrs
+}
@@ -0,0 +1,125 @@
+package mockdns
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+const testZoneFile = `$TTL 3600
+@	IN	SOA	ns1 hostmaster 1 900 900 1800 60
+	IN	NS	ns1
+	IN	MX	10 mx1
+	IN	MX	20 mx2
+	IN	A	192.0.2.2
+	IN	A	192.0.2.1
+	IN	TXT	"v=spf1 " "-all"
+ns1	IN	A	192.0.2.53
+www	IN	CNAME	@
+_imap._tcp	IN	SRV	0 1 143 mx1
+`
+
+func TestParseZone(t *testing.T) {
+	zones, err := ParseZone(strings.NewReader(testZoneFile), "example.org", "example.org.zone")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	apex := zones["example.org."]
+	if want := []string{"192.0.2.2", "192.0.2.1"}; !reflect.DeepEqual(apex.A, want) {
+		t.Errorf("Wrong A records, want %v, got %v", want, apex.A)
+	}
+	if want := []string{"v=spf1 -all"}; !reflect.DeepEqual(apex.TXT, want) {
+		t.Errorf("Wrong TXT records, want %v, got %v", want, apex.TXT)
+	}
+	wantMX := []net.MX{{Host: "mx1.example.org.", Pref: 10}, {Host: "mx2.example.org.", Pref: 20}}
+	if !reflect.DeepEqual(apex.MX, wantMX) {
+		t.Errorf("Wrong MX records, want %v, got %v", wantMX, apex.MX)
+	}
+	if want := []net.NS{{Host: "ns1.example.org."}}; !reflect.DeepEqual(apex.NS, want) {
+		t.Errorf("Wrong NS records, want %v, got %v", want, apex.NS)
+	}
+	if len(apex.Misc[dns.Type(dns.TypeSOA)]) != 1 {
+		t.Errorf("SOA record is missing")
+	}
+	if cname := zones["www.example.org."].CNAME; cname != "example.org." {
+		t.Errorf("Wrong CNAME: %v", cname)
+	}
+	wantSRV := []net.SRV{{Target: "mx1.example.org.", Port: 143, Priority: 0, Weight: 1}}
+	if srv := zones["_imap._tcp.example.org."].SRV; !reflect.DeepEqual(srv, wantSRV) {
+		t.Errorf("Wrong SRV records, want %v, got %v", wantSRV, srv)
+	}
+
+	_, err = ParseZone(strings.NewReader("@ IN A 1.2.3\n"), "example.org", "broken.zone")
+	if err == nil || !strings.Contains(err.Error(), "broken.zone") {
+		t.Errorf("Expected error mentioning file name, got %v", err)
+	}
+}
+
+func TestParseZone_ServedOrder(t *testing.T) {
+	const file = `$TTL 3600
+@	IN	A	192.0.2.3
+	IN	A	192.0.2.1
+	IN	A	192.0.2.2
+	IN	MX	20 mx2
+	IN	MX	10 mx1
+	IN	MX	30 mx3
+	IN	CAA	0 issue "c.example.net"
+	IN	CAA	0 issue "a.example.net"
+	IN	CAA	0 issue "b.example.net"
+`
+	zones, err := ParseZone(strings.NewReader(file), "example.org", "example.org.zone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := NewServer(zones)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	cases := []struct {
+		qtype uint16
+		want  []string
+	}{
+		{dns.TypeA, []string{"192.0.2.3", "192.0.2.1", "192.0.2.2"}},
+		{dns.TypeMX, []string{"20 mx2.example.org.", "10 mx1.example.org.", "30 mx3.example.org."}},
+		{dns.TypeCAA, []string{`0 issue "c.example.net"`, `0 issue "a.example.net"`, `0 issue "b.example.net"`}},
+	}
+	for _, c := range cases {
+		msg := new(dns.Msg)
+		msg.SetQuestion("example.org.", c.qtype)
+		reply, err := srv.Exchange(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got []string
+		for _, rr := range reply.Answer {
+			// Strip the header.
+			hdr := rr.Header().String()
+			got = append(got, strings.TrimPrefix(rr.String(), hdr))
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: wrong order, want %v, got %v", dns.TypeToString[c.qtype], c.want, got)
+		}
+	}
+}
+
+func TestParseZone_BinaryTXT(t *testing.T) {
+	const file = `$TTL 3600
+@	IN	TXT	"caf\195\169 \"quoted\" back\\slash nul\000"
+	IN	TXT	"héllo"
+`
+	zones, err := ParseZone(strings.NewReader(file), "example.org", "example.org.zone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"café \"quoted\" back\\slash nul\x00", "héllo"}
+	if got := zones["example.org."].TXT; !reflect.DeepEqual(got, want) {
+		t.Errorf("Wrong TXT records\nwant %q\n got %q", want, got)
+	}
+}